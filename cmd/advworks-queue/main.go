@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sjbodzo/review_system/db"
+	"github.com/sjbodzo/review_system/queue"
+)
+
+var dbflags struct {
+	port     int
+	endpoint string
+	database string
+	user     string
+	pw       string
+}
+var backend string
+var redisflags struct {
+	mode           string
+	stream         string
+	group          string
+	jobsKey        string
+	reqQueueName   string
+	procQueueName  string
+	retryQueueName string
+	deadQueueName  string
+	leaseSeconds   int
+	endpoint       string
+	port           int
+}
+
+const usage = `Usage: advworks-queue [flags] <command> [args]
+
+Commands:
+  queue depth                  count the jobs waiting, being processed, waiting on a retry and dead
+  queue peek <queue> [count]   show the next jobs in req, proc or retry, or the latest dead letters
+  queue requeue-stuck [secs]   requeue jobs whose lease ran out at least secs ago (default 0)
+  queue drain <queue> <file>   move every job in req, retry or dead to a JSONL file
+  queue load <queue> <file>    push the jobs in a JSONL file onto req, or its dead letters onto dead
+  dead list [start] [stop]     list dead letters, most recently failed first
+  dead inspect <index>         show the dead letter at index in full
+  dead replay <index>|all      move dead letter(s) back onto the request queue
+  dead purge <index>|all       discard dead letter(s) for good
+  job remove <id>              remove a job from wherever it's queued, without processing it
+  job requeue <id>             move a job back onto the request queue, e.g. if it's stuck
+  stream consumers             list the consumers reading the stream (stream mode)
+  stream pending [count]       list entries delivered but not yet acked (stream mode)
+
+With -queue=postgres, only the dead commands are supported, and they take the job's row
+in the ProductReviewJob table, as shown by dead list, in place of an index:
+  dead list [offset] [limit]   list dead jobs, most recently failed first
+  dead inspect <row>           show the dead job in full
+  dead replay <row>|all        move dead job(s) back to be reserved again
+  dead purge <row>|all         discard dead job(s) for good
+
+Flags:
+`
+
+func init() {
+	flag.StringVar(&backend, "queue", "redis", "Queue backend to administer: redis or postgres")
+	flag.IntVar(&dbflags.port, "dbPort", 5432, "Port to connect to database with")
+	flag.StringVar(&dbflags.endpoint, "dbEndpoint", "", "Database endpoint to connect to")
+	flag.StringVar(&dbflags.database, "database", "", "Which database to connect to")
+	flag.StringVar(&dbflags.pw, "dbPw", "", "Password to use when connecting to the database")
+	flag.StringVar(&dbflags.user, "dbUser", "", "User to use when connecting to the database")
+	flag.IntVar(&redisflags.port, "redisPort", 6379, "Port to connect to redis with")
+	flag.StringVar(&redisflags.endpoint, "redisEndpoint", "", "Redis endpoint to connect to")
+	flag.StringVar(&redisflags.mode, "redisMode", queue.ListMode,
+		"How product review jobs are queued in redis: list or stream")
+	flag.StringVar(&redisflags.stream, "redisStream", "review_stream",
+		"Name of redis stream product review jobs are queued in, in stream mode")
+	flag.StringVar(&redisflags.group, "redisGroup", "approverd",
+		"Name of the consumer group reading the redis stream, in stream mode")
+	flag.StringVar(&redisflags.jobsKey, "redisJobsKey", "jobs",
+		"Name of redis hash where the payloads of queued product review jobs are kept")
+	flag.StringVar(&redisflags.reqQueueName, "redisReqQueueName", "req_queue",
+		"Name of redis queue where new or retried product review jobs go")
+	flag.StringVar(&redisflags.procQueueName, "redisProcQueueName", "proc_queue",
+		"Name of redis queue to stage product reviews in while being reviewed")
+	flag.StringVar(&redisflags.retryQueueName, "redisRetryQueueName", "retry_queue",
+		"Name of redis sorted set where product review jobs wait out their backoff before a retry")
+	flag.StringVar(&redisflags.deadQueueName, "redisDeadQueueName", "dead_queue",
+		"Name of redis queue where product review jobs that can't be processed go")
+	flag.IntVar(&redisflags.leaseSeconds, "leaseSeconds", 30,
+		"How many seconds approverd has to process a product review, for finding stuck jobs in stream mode")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+}
+
+func main() {
+	if err := run(flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	if len(args) < 2 || (args[0] != "dead" && args[0] != "job" && args[0] != "stream" && args[0] != "queue") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch backend {
+	case "postgres":
+		if args[0] != "dead" {
+			return fmt.Errorf("Only the dead commands are supported with the postgres queue")
+		}
+		wrapper, err := db.New(dbflags.endpoint, dbflags.port, dbflags.user, dbflags.pw, dbflags.database)
+		if err != nil {
+			return err
+		}
+		defer wrapper.Close()
+		return runPostgresDead(queue.NewPostgresQueue(wrapper), args[1], args[2:])
+	case "redis":
+	default:
+		return fmt.Errorf("Unknown queue backend %q", backend)
+	}
+
+	pool := queue.NewWorkerPool(redisflags.endpoint, redisflags.port)
+	pool.Mode = redisflags.mode
+	pool.Stream = redisflags.stream
+	pool.Group = redisflags.group
+	pool.JobsKey = redisflags.jobsKey
+	pool.ReqQueue = redisflags.reqQueueName
+	pool.ProcQueue = redisflags.procQueueName
+	pool.RetryQueue = redisflags.retryQueueName
+	pool.DeadLetterQueue = redisflags.deadQueueName
+	pool.LeaseTimeout = time.Duration(redisflags.leaseSeconds) * time.Second
+	switch args[0] {
+	case "queue":
+		return runQueue(pool, args[1], args[2:])
+	case "job":
+		return runJob(pool, args[1], args[2:])
+	case "stream":
+		return runStream(pool, args[1], args[2:])
+	}
+	return runDead(pool, args[1], args[2:])
+}
+
+// runQueue runs one of the commands inspecting or moving the jobs in a whole queue
+func runQueue(pool *queue.WorkerPool, cmd string, args []string) error {
+	switch cmd {
+	case "depth":
+		depths, err := pool.Depths()
+		if err != nil {
+			return err
+		}
+		req := depths.Req[queue.PriorityHigh] + depths.Req[queue.PriorityNormal] + depths.Req[queue.PriorityLow]
+		fmt.Printf("req\t%d\t(%d high, %d normal, %d low)\n", req, depths.Req[queue.PriorityHigh],
+			depths.Req[queue.PriorityNormal], depths.Req[queue.PriorityLow])
+		fmt.Printf("proc\t%d\n", depths.Proc)
+		fmt.Printf("retry\t%d\n", depths.Retry)
+		fmt.Printf("dead\t%d\n", depths.Dead)
+		return nil
+
+	case "peek":
+		if len(args) < 1 {
+			return fmt.Errorf("Expected a queue to peek at")
+		}
+		count := 10
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("Invalid count %q", args[1])
+			}
+			count = n
+		}
+		if args[0] == "dead" {
+			return runDead(pool, "list", []string{"0", strconv.Itoa(count - 1)})
+		}
+
+		jobs, err := pool.PeekJobs(args[0], count)
+		if err != nil {
+			return err
+		}
+		for _, job := range jobs {
+			fmt.Printf("%s\t%s\t%s priority\t%d attempts\treview %d by %s\n", job.ID,
+				job.EnqueuedAt.Format("2006-01-02T15:04:05Z07:00"), job.Priority, job.Attempts, job.ReviewID,
+				job.Review.EmailAddress)
+		}
+		return nil
+
+	case "requeue-stuck":
+		var grace time.Duration
+		if len(args) > 0 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 0 {
+				return fmt.Errorf("Invalid number of seconds %q", args[0])
+			}
+			grace = time.Duration(n) * time.Second
+		}
+
+		ids, err := pool.StuckJobs(grace)
+		if err != nil {
+			return err
+		}
+		for i, id := range ids {
+			if err := pool.RequeueJob(id); err != nil {
+				return fmt.Errorf("Requeued %d of %d stuck jobs before failing\nError: %v", i, len(ids), err)
+			}
+			fmt.Printf("Requeued job %s\n", id)
+		}
+		fmt.Printf("Requeued %d stuck jobs\n", len(ids))
+		return nil
+
+	case "drain":
+		if len(args) != 2 {
+			return fmt.Errorf("Expected a queue to drain and a file to drain it to")
+		}
+		return drainQueue(pool, args[0], args[1])
+
+	case "load":
+		if len(args) != 2 {
+			return fmt.Errorf("Expected a queue to load and a file to load it from")
+		}
+		return loadQueue(pool, args[0], args[1])
+	}
+
+	return fmt.Errorf("Unknown command %q", "queue "+cmd)
+}
+
+// drainQueue moves every job in the named queue to the end of a JSONL file, one job (or
+// dead letter) per line, oldest first
+func drainQueue(pool *queue.WorkerPool, from string, path string) (err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to open %s\nError: %v", path, err)
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("Unable to write %s\nError: %v", path, closeErr)
+		}
+	}()
+
+	// each line is synced as it's written, so next to nothing is lost if the drain is cut short
+	writeLine := func(v interface{}) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(append(b, '\n')); err != nil {
+			return err
+		}
+		return f.Sync()
+	}
+
+	if from == "dead" {
+		n, err := pool.DeadLetterCount()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			letter, err := pool.InspectDeadLetter(-1)
+			if err != nil {
+				return err
+			}
+			if err := writeLine(letter); err != nil {
+				return fmt.Errorf("Drained %d of %d dead letters before failing\nError: %v", i, n, err)
+			}
+			if err := pool.PurgeDeadLetter(-1); err != nil {
+				return fmt.Errorf("Drained %d of %d dead letters before failing\nError: %v", i, n, err)
+			}
+		}
+		fmt.Printf("Drained %d dead letters to %s\n", n, path)
+		return nil
+	}
+
+	drained, err := pool.DrainJobs(from, func(job *queue.ProductReviewJob) error {
+		return writeLine(job)
+	})
+	if err != nil {
+		return fmt.Errorf("Drained %d jobs before failing\nError: %v", drained, err)
+	}
+	fmt.Printf("Drained %d jobs to %s\n", drained, path)
+	return nil
+}
+
+// loadQueue pushes the jobs in a JSONL file onto the request queue, or with "dead", adds
+// the dead letters in it back to the dead letter queue, in the order they're written
+func loadQueue(pool *queue.WorkerPool, to string, path string) error {
+	if to != "req" && to != "dead" {
+		return fmt.Errorf("Unable to load the %s queue, expected req or dead", to)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Unable to open %s\nError: %v", path, err)
+	}
+	defer f.Close()
+
+	loaded := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		if to == "dead" {
+			var letter queue.DeadLetter
+			if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+				return fmt.Errorf("Loaded %d dead letters, then couldn't parse line %d\nError: %v", loaded, line, err)
+			}
+			err = pool.AddDeadLetter(&letter)
+		} else {
+			var job queue.ProductReviewJob
+			if err := json.Unmarshal(scanner.Bytes(), &job); err != nil {
+				return fmt.Errorf("Loaded %d jobs, then couldn't parse line %d\nError: %v", loaded, line, err)
+			}
+			err = pool.Push(&job)
+		}
+		if err != nil {
+			return fmt.Errorf("Loaded %d, then failed on line %d\nError: %v", loaded, line, err)
+		}
+		loaded++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Loaded %d, then couldn't read %s\nError: %v", loaded, path, err)
+	}
+	fmt.Printf("Loaded %d from %s\n", loaded, path)
+	return nil
+}
+
+// runStream runs one of the commands inspecting the stream's consumer group
+func runStream(pool *queue.WorkerPool, cmd string, args []string) error {
+	switch cmd {
+	case "consumers":
+		consumers, err := pool.Consumers()
+		if err != nil {
+			return err
+		}
+		for _, consumer := range consumers {
+			fmt.Printf("%s\t%d pending\tidle %s\n", consumer.Name, consumer.Pending, consumer.Idle)
+		}
+		return nil
+
+	case "pending":
+		count := 100
+		if len(args) > 0 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 1 {
+				return fmt.Errorf("Invalid count %q", args[0])
+			}
+			count = n
+		}
+
+		pending, err := pool.PendingEntries(count)
+		if err != nil {
+			return err
+		}
+		for _, entry := range pending {
+			summary := "deleted entry"
+			if job, err := pool.StreamJob(entry.Stream, entry.EntryID); err == nil {
+				summary = fmt.Sprintf("job %s: review %d, %s priority", job.ID, job.ReviewID, job.Priority)
+			}
+			fmt.Printf("%s\t%s\t%s\tidle %s\t%d deliveries\t%s\n", entry.Stream, entry.EntryID, entry.Consumer,
+				entry.Idle, entry.Deliveries, summary)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Unknown command %q", "stream "+cmd)
+}
+
+// runJob runs one of the commands acting on a single queued job
+func runJob(pool *queue.WorkerPool, cmd string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Expected a single job ID")
+	}
+	id := args[0]
+
+	switch cmd {
+	case "remove":
+		removed, err := pool.RemoveJob(id)
+		if err != nil {
+			return err
+		} else if !removed {
+			fmt.Printf("Job %s was already gone\n", id)
+			return nil
+		}
+		fmt.Printf("Removed job %s\n", id)
+		return nil
+
+	case "requeue":
+		if err := pool.RequeueJob(id); err != nil {
+			return err
+		}
+		fmt.Printf("Requeued job %s\n", id)
+		return nil
+	}
+
+	return fmt.Errorf("Unknown command %q", "job "+cmd)
+}
+
+// runDead runs one of the dead letter queue commands
+func runDead(pool *queue.WorkerPool, cmd string, args []string) error {
+	switch cmd {
+	case "list":
+		start, stop := 0, -1
+		if len(args) > 0 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("Invalid start index %q", args[0])
+			}
+			start = n
+		}
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("Invalid stop index %q", args[1])
+			}
+			stop = n
+		}
+
+		letters, err := pool.DeadLetters(start, stop)
+		if err != nil {
+			return err
+		}
+		for i, letter := range letters {
+			summary := "unparseable job"
+			if letter.Job != nil {
+				summary = fmt.Sprintf("job %s: review %d by %s", letter.Job.ID, letter.Job.ReviewID,
+					letter.Job.Review.EmailAddress)
+			}
+			fmt.Printf("%d\t%s\t%s\t%q\n", start+i, letter.FailedAt.Format("2006-01-02T15:04:05Z07:00"),
+				summary, letter.Reason)
+		}
+		return nil
+
+	case "inspect":
+		index, err := indexArg(args)
+		if err != nil {
+			return err
+		}
+		letter, err := pool.InspectDeadLetter(index)
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(letter, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+
+	case "replay":
+		return eachDeadLetter(pool, args, "Replayed", func(index int) error {
+			return pool.ReplayDeadLetter(index, redisflags.reqQueueName)
+		})
+
+	case "purge":
+		if len(args) == 1 && args[0] == "all" {
+			n, err := pool.PurgeDeadLetters()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Purged %d dead letters\n", n)
+			return nil
+		}
+		return eachDeadLetter(pool, args, "Purged", pool.PurgeDeadLetter)
+	}
+
+	return fmt.Errorf("Unknown command %q", "dead "+cmd)
+}
+
+// runPostgresDead runs one of the dead letter commands against the postgres job table
+func runPostgresDead(q *queue.PostgresQueue, cmd string, args []string) error {
+	switch cmd {
+	case "list":
+		offset, limit := 0, 100
+		if len(args) > 0 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 0 {
+				return fmt.Errorf("Invalid offset %q", args[0])
+			}
+			offset = n
+		}
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("Invalid limit %q", args[1])
+			}
+			limit = n
+		}
+
+		dead, err := q.DeadJobs(offset, limit)
+		if err != nil {
+			return err
+		}
+		for _, job := range dead {
+			summary := "unparseable job"
+			if job.Job != nil {
+				summary = fmt.Sprintf("job %s: review %d by %s", job.Job.ID, job.Job.ReviewID,
+					job.Job.Review.EmailAddress)
+			}
+			fmt.Printf("%d\t%s\t%s\t%q\n", job.RowID, job.FailedAt.Format("2006-01-02T15:04:05Z07:00"),
+				summary, job.Reason)
+		}
+		return nil
+
+	case "inspect":
+		row, err := rowArg(args)
+		if err != nil {
+			return err
+		}
+		job, err := q.InspectDeadJob(row)
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(job, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+
+	case "replay":
+		if len(args) == 1 && args[0] == "all" {
+			replayed := 0
+			for {
+				// replayed jobs leave the dead letters, so the first page is always the next
+				dead, err := q.DeadJobs(0, 100)
+				if err != nil {
+					return fmt.Errorf("Replayed %d dead jobs before failing\nError: %v", replayed, err)
+				} else if len(dead) == 0 {
+					break
+				}
+				for _, job := range dead {
+					if err := q.ReplayDeadJob(job.RowID); err != nil {
+						return fmt.Errorf("Replayed %d dead jobs before failing\nError: %v", replayed, err)
+					}
+					replayed++
+				}
+			}
+			fmt.Printf("Replayed %d dead jobs\n", replayed)
+			return nil
+		}
+		row, err := rowArg(args)
+		if err != nil {
+			return err
+		}
+		if err := q.ReplayDeadJob(row); err != nil {
+			return err
+		}
+		fmt.Printf("Replayed dead job %d\n", row)
+		return nil
+
+	case "purge":
+		if len(args) == 1 && args[0] == "all" {
+			n, err := q.PurgeDeadJobs()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Purged %d dead jobs\n", n)
+			return nil
+		}
+		row, err := rowArg(args)
+		if err != nil {
+			return err
+		}
+		if err := q.PurgeDeadJob(row); err != nil {
+			return err
+		}
+		fmt.Printf("Purged dead job %d\n", row)
+		return nil
+	}
+
+	return fmt.Errorf("Unknown command %q", "dead "+cmd)
+}
+
+// rowArg parses the single job table row the command was given
+func rowArg(args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("Expected a single job row")
+	}
+	row, err := strconv.Atoi(args[0])
+	if err != nil || row < 1 {
+		return 0, fmt.Errorf("Invalid job row %q", args[0])
+	}
+	return row, nil
+}
+
+// eachDeadLetter applies fn to the dead letter at the index in args, or to every
+// dead letter, oldest first, if args is "all"
+func eachDeadLetter(pool *queue.WorkerPool, args []string, verb string, fn func(index int) error) error {
+	if len(args) == 1 && args[0] == "all" {
+		n, err := pool.DeadLetterCount()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := fn(-1); err != nil {
+				return fmt.Errorf("%s %d of %d dead letters before failing\nError: %v", verb, i, n, err)
+			}
+		}
+		fmt.Printf("%s %d dead letters\n", verb, n)
+		return nil
+	}
+
+	index, err := indexArg(args)
+	if err != nil {
+		return err
+	}
+	if err := fn(index); err != nil {
+		return err
+	}
+	fmt.Printf("%s dead letter %d\n", verb, index)
+	return nil
+}
+
+// indexArg parses the single dead letter index the command was given
+func indexArg(args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("Expected a single dead letter index")
+	}
+	index, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, fmt.Errorf("Invalid dead letter index %q", args[0])
+	}
+	return index, nil
+}
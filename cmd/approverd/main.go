@@ -1,30 +1,112 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/sjbodzo/review_system/db"
 	"github.com/sjbodzo/review_system/queue"
+	"github.com/sjbodzo/review_system/review"
 )
 
+var dbflags struct {
+	port     int
+	endpoint string
+	database string
+	user     string
+	pw       string
+}
+var queueflags struct {
+	backend       string
+	workers       int
+	maxAttempts   int
+	retryBaseSecs int
+	retryMaxSecs  int
+	retryJitter   float64
+	pollMillis    int
+	laneWeights   string
+	drainSeconds  int
+	pipeline      string
+	lexicon       string
+	lexiconSecs   int
+}
 var redisflags struct {
-	pollSeconds   int
-	reqQueueName  string
-	procQueueName string
-	endpoint      string
-	port          int
+	mode           string
+	stream         string
+	group          string
+	consumer       string
+	jobsKey        string
+	blockSeconds   int
+	leaseSeconds   int
+	reapSeconds    int
+	reqQueueName   string
+	procQueueName  string
+	deadQueueName  string
+	retryQueueName string
+	endpoint       string
+	port           int
 }
 
 func init() {
+	flag.IntVar(&dbflags.port, "dbPort", 5432, "Port to connect to database with")
+	flag.StringVar(&dbflags.endpoint, "dbEndpoint", "", "Database endpoint to connect to")
+	flag.StringVar(&dbflags.database, "database", "", "Which database to connect to")
+	flag.StringVar(&dbflags.pw, "dbPw", "", "Password to use when connecting to the database")
+	flag.StringVar(&dbflags.user, "dbUser", "", "User to use when connecting to the database")
+	flag.StringVar(&queueflags.backend, "queue", "redis", "Queue backend to consume product reviews from: redis or postgres")
+	flag.IntVar(&queueflags.workers, "workers", 4, "How many product reviews to process concurrently")
+	flag.IntVar(&queueflags.maxAttempts, "maxAttempts", 3,
+		"Max number of times to try processing a product review before giving up on it")
+	flag.IntVar(&queueflags.retryBaseSecs, "retryBaseSeconds", 5,
+		"How many seconds to wait before the first retry; each retry after doubles it")
+	flag.IntVar(&queueflags.retryMaxSecs, "retryMaxSeconds", 300, "Max number of seconds to wait before a retry")
+	flag.Float64Var(&queueflags.retryJitter, "retryJitter", 0.2,
+		"Fraction (0 to 1) by which to randomize each retry delay")
+	flag.IntVar(&queueflags.pollMillis, "pollMillis", 500,
+		"How many milliseconds to wait between checks for new product reviews with the postgres queue")
+	flag.StringVar(&queueflags.laneWeights, "laneWeights", "high=4,normal=2,low=1",
+		"How often each priority lane of product reviews is drained first, relative to the others")
+	flag.IntVar(&queueflags.drainSeconds, "drainSeconds", 10,
+		"How many seconds to wait on shutdown for product reviews being processed to finish before releasing them")
+	flag.StringVar(&queueflags.pipeline, "pipeline", "",
+		"Path to a json file listing the reviewers and notifiers product reviews go through (the defaults if unset)")
+	flag.StringVar(&queueflags.lexicon, "lexicon", "",
+		"Where to load the language reviewer's terms from: a json file, or postgres for the ModerationTerm table (the built in terms if unset)")
+	flag.IntVar(&queueflags.lexiconSecs, "lexiconReloadSeconds", 30,
+		"How often to check the lexicon for changes; SIGHUP checks it straight away")
 	flag.IntVar(&redisflags.port, "redisPort", 6379, "Port to connect to database with")
-	flag.IntVar(&redisflags.pollSeconds, "pollSeconds", 5, "How many seconds to wait between polling")
+	flag.IntVar(&redisflags.blockSeconds, "blockSeconds", 1,
+		"How many seconds a worker blocks waiting on a new product review before checking in")
+	flag.IntVar(&redisflags.leaseSeconds, "leaseSeconds", 30,
+		"How many seconds a worker has to process a product review before it's handed to another")
+	flag.IntVar(&redisflags.reapSeconds, "reapSeconds", 10,
+		"How many seconds to wait between checks for product reviews with expired leases")
 	flag.StringVar(&redisflags.endpoint, "redisEndpoint", "", "Database endpoint to connect to")
 	flag.StringVar(&redisflags.procQueueName, "redisProcQueueName", "proc_queue",
 		"Name of redis queue to stage product reviews in while being reviewed")
+	flag.StringVar(&redisflags.mode, "redisMode", queue.ListMode,
+		"How product review jobs are queued in redis: list, or stream to read them as a consumer group")
+	flag.StringVar(&redisflags.stream, "redisStream", "review_stream",
+		"Name of redis stream product review jobs are queued in, in stream mode")
+	flag.StringVar(&redisflags.group, "redisGroup", "approverd",
+		"Name of the consumer group reading the redis stream, in stream mode")
+	flag.StringVar(&redisflags.consumer, "redisConsumer", queue.DefaultConsumer(),
+		"Name this approverd reads the redis stream as, unique within its consumer group, in stream mode")
+	flag.StringVar(&redisflags.jobsKey, "redisJobsKey", "jobs",
+		"Name of redis hash where the payloads of queued product review jobs are kept")
 	flag.StringVar(&redisflags.reqQueueName, "redisReqQueueName", "req_queue",
 		"Name of redis queue where new or retried product review jobs go")
+	flag.StringVar(&redisflags.deadQueueName, "redisDeadQueueName", "dead_queue",
+		"Name of redis queue where product review jobs that can't be processed go")
+	flag.StringVar(&redisflags.retryQueueName, "redisRetryQueueName", "retry_queue",
+		"Name of redis sorted set where product review jobs wait out their backoff before a retry")
 	flag.Parse()
 }
 
@@ -41,16 +123,191 @@ func main() {
 	}
 }
 
-func run() error {
-	pool := queue.NewWorkerPool(redisflags.endpoint, redisflags.port)
-	ticker := time.NewTicker(time.Duration(redisflags.pollSeconds) * time.Second)
-	for range ticker.C {
-		go func() {
-			err := pool.ProcessNextReview(redisflags.reqQueueName, redisflags.procQueueName)
-			if err != nil {
-				log.Println("Error:", err.Error())
+// newQueue returns the queue backend chosen by the flags
+func newQueue(wrapper *db.Wrapper) (queue.Queue, error) {
+	backoff := queue.Backoff{
+		BaseDelay: time.Duration(queueflags.retryBaseSecs) * time.Second,
+		MaxDelay:  time.Duration(queueflags.retryMaxSecs) * time.Second,
+		Jitter:    queueflags.retryJitter,
+	}
+	weights, err := queue.ParseLaneWeights(queueflags.laneWeights)
+	if err != nil {
+		return nil, err
+	}
+
+	switch queueflags.backend {
+	case "redis":
+		pool := queue.NewWorkerPool(redisflags.endpoint, redisflags.port)
+		pool.Mode = redisflags.mode
+		pool.Stream = redisflags.stream
+		pool.Group = redisflags.group
+		pool.Consumer = redisflags.consumer
+		pool.JobsKey = redisflags.jobsKey
+		pool.ReqQueue = redisflags.reqQueueName
+		pool.ProcQueue = redisflags.procQueueName
+		pool.BlockTimeout = time.Duration(redisflags.blockSeconds) * time.Second
+		pool.LeaseTimeout = time.Duration(redisflags.leaseSeconds) * time.Second
+		pool.ReapInterval = time.Duration(redisflags.reapSeconds) * time.Second
+		pool.DeadLetterQueue = redisflags.deadQueueName
+		pool.RetryQueue = redisflags.retryQueueName
+		pool.MaxAttempts = queueflags.maxAttempts
+		pool.Backoff = backoff
+		pool.LaneWeights = weights
+		return pool, nil
+	case "postgres":
+		q := queue.NewPostgresQueue(wrapper)
+		q.PollInterval = time.Duration(queueflags.pollMillis) * time.Millisecond
+		q.BlockTimeout = time.Duration(redisflags.blockSeconds) * time.Second
+		q.LeaseTimeout = time.Duration(redisflags.leaseSeconds) * time.Second
+		q.ReapInterval = time.Duration(redisflags.reapSeconds) * time.Second
+		q.MaxAttempts = queueflags.maxAttempts
+		q.Backoff = backoff
+		q.LaneWeights = weights
+		return q, nil
+	case "memory":
+		// nothing outside this process could push to it, so approverd would sit idle
+		return nil, fmt.Errorf("approverd can't consume the memory queue, run receiverd -queue=memory instead")
+	}
+	return nil, fmt.Errorf("Unknown queue backend %q", queueflags.backend)
+}
+
+// newLexiconLoader loads the lexicon from the file, or the ModerationTerm table, named by -lexicon
+func newLexiconLoader(wrapper *db.Wrapper) review.LexiconLoader {
+	if queueflags.lexicon != "postgres" {
+		path := queueflags.lexicon
+		return func() (*review.Lexicon, error) {
+			return review.LoadLexiconFile(path)
+		}
+	}
+
+	return func() (*review.Lexicon, error) {
+		terms, err := wrapper.ListModerationTerms()
+		if err != nil {
+			return nil, err
+		}
+		lex := review.Lexicon{Locales: make(map[string]*review.Lexicon)}
+		for _, term := range terms {
+			// terms for a particular language go in its locale
+			locale := &lex
+			if term.CultureID != nil {
+				if locale = lex.Locales[*term.CultureID]; locale == nil {
+					locale = &review.Lexicon{}
+					lex.Locales[*term.CultureID] = locale
+				}
+			}
+
+			switch term.Kind {
+			case db.TermBlacklist:
+				locale.Blacklist = append(locale.Blacklist, term.Term)
+			case db.TermAllowlist:
+				locale.Allowlist = append(locale.Allowlist, term.Term)
+			case db.TermSubstring:
+				locale.Substrings = append(locale.Substrings, term.Term)
+			case db.TermWildcard:
+				locale.Wildcards = append(locale.Wildcards, term.Term)
+			case db.TermPattern:
+				locale.Patterns = append(locale.Patterns, term.Term)
 			}
-		}()
+		}
+		lex.SetVersion()
+		return &lex, nil
+	}
+}
+
+// lookupProduct looks up when products are on sale in the Product table
+func lookupProduct(wrapper *db.Wrapper) review.ProductLookup {
+	return func(productID int) (*review.ProductLifecycle, error) {
+		row, err := wrapper.GetProduct(productID)
+		if err == db.ErrNotFound {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return &review.ProductLifecycle{
+			SellStartDate:    row.SellStartDate,
+			SellEndDate:      row.SellEndDate,
+			DiscontinuedDate: row.DiscontinuedDate,
+		}, nil
+	}
+}
+
+func run() error {
+	wrapper, err := db.New(dbflags.endpoint, dbflags.port, dbflags.user,
+		dbflags.pw, dbflags.database)
+	if err != nil {
+		return err
+	}
+	defer wrapper.Close()
+
+	q, err := newQueue(wrapper)
+	if err != nil {
+		return err
+	}
+
+	if closer, ok := q.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	processor := queue.NewProcessor(q, wrapper)
+	processor.Workers = queueflags.workers
+	if queueflags.pipeline != "" {
+		config, err := review.LoadPipelineConfig(queueflags.pipeline)
+		if err != nil {
+			return err
+		}
+		factories := review.DefaultFactories()
+		factories.Reviewers["verifiedPurchase"] = review.VerifiedPurchaseFactory(wrapper)
+		factories.Reviewers["productLifecycle"] = review.ProductLifecycleFactory(lookupProduct(wrapper))
+		if processor.Pipeline, err = config.Build(factories); err != nil {
+			return err
+		}
+		reviewers, notifiers := config.Enabled()
+		log.Printf("Reviewing with %v, notifying with %v\n", reviewers, notifiers)
+		if config.Scoring != nil {
+			log.Printf("Scoring reviewers with weights %v, approving below %v and rejecting above %v\n",
+				processor.Pipeline.Weights, config.Scoring.ApproveBelow, config.Scoring.RejectAbove)
+		}
+	}
+	processor.DrainTimeout = time.Duration(queueflags.drainSeconds) * time.Second
+
+	var loadLexicon review.LexiconLoader
+	var lexiconVersion string
+	if queueflags.lexicon != "" {
+		loadLexicon = newLexiconLoader(wrapper)
+		lex, err := loadLexicon()
+		if err != nil {
+			return err
+		}
+		if err := processor.Pipeline.SetLexicon(lex); err != nil {
+			return err
+		}
+		lexiconVersion = lex.Version
+		log.Printf("Loaded lexicon version %s (%d terms) from %s\n", lex.Version, lex.Size(), queueflags.lexicon)
+	}
+
+	// stop taking on new reviews on SIGINT or SIGTERM, and drain the ones in flight
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		log.Printf("Received %v, shutting down\n", <-sig)
+		stop()
+	}()
+
+	// pick up changes to the lexicon as they're made, or on SIGHUP
+	if loadLexicon != nil {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go review.WatchLexicon(ctx, loadLexicon, processor.Pipeline.SetLexicon, lexiconVersion,
+			time.Duration(queueflags.lexiconSecs)*time.Second, reload)
+	}
+
+	log.Printf("Processing product reviews from the %s queue with %d workers\n",
+		queueflags.backend, processor.Workers)
+	if err := processor.Run(ctx); err != context.Canceled {
+		return err
 	}
+	log.Println("Shut down cleanly")
 	return nil
 }
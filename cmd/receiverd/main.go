@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/sjbodzo/review_system/db"
 	"github.com/sjbodzo/review_system/queue"
@@ -21,9 +29,20 @@ var apiflags struct {
 	version string
 	port    int
 }
+var queueflags struct {
+	backend       string
+	workers       int
+	relayMillis   int
+	priorityRules string
+	drainSeconds  int
+}
 var redisflags struct {
-	endpoint string
-	port     int
+	mode         string
+	stream       string
+	jobsKey      string
+	endpoint     string
+	port         int
+	reqQueueName string
 }
 
 func init() {
@@ -36,6 +55,24 @@ func init() {
 	flag.StringVar(&dbflags.user, "dbUser", "", "User to use when connecting to the database")
 	flag.IntVar(&redisflags.port, "redisPort", 6379, "Port to connect to database with")
 	flag.StringVar(&redisflags.endpoint, "redisEndpoint", "", "Database endpoint to connect to")
+	flag.StringVar(&redisflags.mode, "redisMode", queue.ListMode,
+		"How product review jobs are queued in redis: list, or stream to add them to a redis stream")
+	flag.StringVar(&redisflags.stream, "redisStream", "review_stream",
+		"Name of redis stream product review jobs are queued in, in stream mode")
+	flag.StringVar(&redisflags.jobsKey, "redisJobsKey", "jobs",
+		"Name of redis hash where the payloads of queued product review jobs are kept")
+	flag.StringVar(&redisflags.reqQueueName, "redisReqQueueName", "req_queue",
+		"Name of redis queue where new or retried product review jobs go")
+	flag.StringVar(&queueflags.backend, "queue", "redis",
+		"Queue backend to push product reviews to: redis, postgres, or memory to also approve them in this process")
+	flag.IntVar(&queueflags.workers, "workers", 4,
+		"How many product reviews to approve concurrently when using the memory queue")
+	flag.IntVar(&queueflags.relayMillis, "relayMillis", 500,
+		"How many milliseconds to wait between checks for saved product reviews to push to the queue")
+	flag.IntVar(&queueflags.drainSeconds, "drainSeconds", 10,
+		"How many seconds to wait on shutdown for requests and product reviews in flight to finish")
+	flag.StringVar(&queueflags.priorityRules, "priorityRules", "",
+		"Path to a json file of rules deciding the priority product reviews are queued with (all normal if unset)")
 	flag.Parse()
 }
 
@@ -58,13 +95,97 @@ func run() error {
 	if err != nil {
 		return err
 	}
+	defer wrapper.Close()
+
+	// stop on SIGINT or SIGTERM, once the requests and reviews in flight are done with
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		log.Printf("Received %v, shutting down\n", <-sig)
+		stop()
+	}()
+	drain := time.Duration(queueflags.drainSeconds) * time.Second
+
+	// background is what runs alongside the server, waited on at shutdown
+	var background sync.WaitGroup
+	var q queue.Queue
+	switch queueflags.backend {
+	case "redis":
+		pool := queue.NewWorkerPool(redisflags.endpoint, redisflags.port)
+		pool.Mode = redisflags.mode
+		pool.Stream = redisflags.stream
+		pool.JobsKey = redisflags.jobsKey
+		pool.ReqQueue = redisflags.reqQueueName
+		q = pool
+	case "postgres":
+		q = queue.NewPostgresQueue(wrapper)
+	case "memory":
+		// nothing outside this process can see the queue, so approve reviews right here
+		q = queue.NewMemoryQueue()
+		processor := queue.NewProcessor(q, wrapper)
+		processor.Workers = queueflags.workers
+		processor.DrainTimeout = drain
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			processor.Run(ctx)
+		}()
+		log.Printf("Approving product reviews in process with %d workers\n", processor.Workers)
+	default:
+		return fmt.Errorf("Unknown queue backend %q", queueflags.backend)
+	}
+	if closer, ok := q.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	var rules *queue.PriorityRules
+	if queueflags.priorityRules != "" {
+		if rules, err = queue.LoadPriorityRules(queueflags.priorityRules); err != nil {
+			return err
+		}
+		log.Printf("Prioritizing product reviews with %d rules\n", len(rules.Rules))
+	}
 
-	pool := queue.NewWorkerPool(redisflags.endpoint, redisflags.port)
-	srv, err := server.New(apiflags.port, apiflags.version, wrapper, pool)
+	// the server only saves reviews; the relay pushes them from the outbox onto the queue
+	relay := queue.NewRelay(wrapper, q)
+	relay.Interval = time.Duration(queueflags.relayMillis) * time.Millisecond
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		relay.Run(ctx)
+	}()
+
+	srv, err := server.New(apiflags.port, apiflags.version, wrapper, rules)
 	if err != nil {
 		return err
 	}
 	log.Println("Server live at", srv.Addr)
-	defer srv.Close()
-	return srv.ListenAndServe()
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-served:
+		stop()
+		background.Wait()
+		return err
+	case <-ctx.Done():
+	}
+
+	// reviews still being saved finish up, and the relay and processor stop after the
+	// batch and the jobs they're on; anything unsent waits in the outbox for next time
+	shutdown, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	if err := srv.Shutdown(shutdown); err != nil {
+		log.Println("Unable to finish requests in flight:", err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		return err
+	}
+	background.Wait()
+	log.Println("Shut down cleanly")
+	return nil
 }
@@ -2,6 +2,8 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -25,6 +27,20 @@ type NullFloat struct {
 	sql.NullFloat64
 }
 
+// ErrNotFound is returned when a lookup doesn't match any row in the database
+var ErrNotFound = errors.New("Not found")
+
+// ReviewStatus is the moderation status of a product review
+type ReviewStatus string
+
+// Moderation statuses a product review moves through
+const (
+	StatusPending           ReviewStatus = "pending"
+	StatusApproved          ReviewStatus = "approved"
+	StatusRejected          ReviewStatus = "rejected"
+	StatusNeedsManualReview ReviewStatus = "needs_manual_review"
+)
+
 // Wrapper is a pointer to the underlying database library instance
 type Wrapper struct {
 	_db    *sql.DB
@@ -41,32 +57,62 @@ type ProductRow struct {
 	Color                 NullString
 	SafetyStockLevel      int
 	ReorderPoint          int
-	StandardCost          int
-	ListPrice             int
-	Size                  string
+	StandardCost          float64
+	ListPrice             float64
+	Size                  NullString
 	SizeUnitMeasureCode   NullString
 	WeightUnitMeasureCode NullString
 	Weight                NullFloat
 	DaysToManufacture     int
 	ProductLine           NullString
+	Class                 NullString
 	Style                 NullString
 	ProductSubcategoryID  NullInt
 	ProductModelID        NullInt
 	SellStartDate         time.Time
-	SellEndDate           time.Time
-	DiscontinuedDate      time.Time
+	SellEndDate           *time.Time
+	DiscontinuedDate      *time.Time
+}
+
+// RatingSummary aggregates the ratings of a product's approved reviews
+type RatingSummary struct {
+	Count     int
+	Average   float64
+	Histogram map[int]int // number of reviews per star rating, 1 through 5
 }
 
 // ProductReviewRow is the data in a row of the ProductReview table in the database
 type ProductReviewRow struct {
-	ProductReviewID int
-	ProductID       int
-	ReviewerName    string
+	ProductReviewID int             `json:"reviewID"`
+	ProductID       int             `json:"productid"`
+	ReviewerName    string          `json:"name"`
+	ReviewDate      time.Time       `json:"reviewDate"`
+	EmailAddress    string          `json:"-"`
+	Rating          int             `json:"rating"`
+	Comments        *string         `json:"review,omitempty"`
+	ModifiedDate    time.Time       `json:"modifiedDate"`
+	Status          ReviewStatus    `json:"status"`
+	DecisionDate    *time.Time      `json:"decisionDate,omitempty"`
+	DecisionReason  *string         `json:"decisionReason,omitempty"`
+	Decisions       json.RawMessage `json:"decisions,omitempty"`
+
+	// VerifiedPurchase is whether the reviewer bought the product, or nil if it hasn't been checked
+	VerifiedPurchase *bool `json:"verifiedPurchase,omitempty"`
+}
+
+// ReviewFilter narrows down which of a product's reviews are listed
+type ReviewFilter struct {
+	ProductID int
+	MinRating *int
+	MaxRating *int
+	Since     *time.Time // inclusive
+	Until     *time.Time // inclusive
+}
+
+// ReviewCursor marks the last review on a page, so the next page can pick up right after it
+type ReviewCursor struct {
 	ReviewDate      time.Time
-	EmailAddress    string
-	Rating          int
-	Comments        *string
-	ModifiedDate    time.Time
+	ProductReviewID int
 }
 
 // retryConn retries a db connection 'retries' times every 'wait' duration if it fails
@@ -85,16 +131,71 @@ func retryConn(retries int, wait time.Duration, db *sql.DB) (err error) {
 
 // prepareStatements prepares each of the sql statements on the db object
 func prepareStatements(db *sql.DB) (statements map[string]*sql.Stmt, err error) {
-	statements = make(map[string]*sql.Stmt, 2)
+	statements = make(map[string]*sql.Stmt)
 
-	// Checks for existence of product review in the system by fetching the review's id
-	getReviewStmnt, err := db.Prepare("SELECT ProductReviewID FROM Production.ProductReview " +
+	// Checks for existence of product review in the system by fetching the review's id and status
+	getReviewStmnt, err := db.Prepare("SELECT ProductReviewID, Status FROM Production.ProductReview " +
 		"WHERE ProductID=$1 AND ReviewerName=$2 AND EmailAddress=$3")
 	if err != nil {
 		return nil, err
 	}
 	statements["GetReview"] = getReviewStmnt
 
+	// Fetches a single product review by its id
+	getReviewByIDStmnt, err := db.Prepare("SELECT ProductReviewID, ProductID, ReviewerName, ReviewDate, " +
+		"EmailAddress, Rating, Comments, ModifiedDate, Status, DecisionDate, DecisionReason, Decisions, VerifiedPurchase " +
+		"FROM Production.ProductReview " +
+		"WHERE ProductReviewID=$1")
+	if err != nil {
+		return nil, err
+	}
+	statements["GetReviewByID"] = getReviewByIDStmnt
+
+	// Lists a product's approved reviews, newest first, starting after the (optional) cursor
+	listReviewsStmnt, err := db.Prepare("SELECT ProductReviewID, ProductID, ReviewerName, ReviewDate, " +
+		"EmailAddress, Rating, Comments, ModifiedDate, Status, DecisionDate, DecisionReason, Decisions, VerifiedPurchase " +
+		"FROM Production.ProductReview " +
+		"WHERE ProductID=$1 AND Status='approved' " +
+		"AND ($2::int IS NULL OR Rating >= $2::int) AND ($3::int IS NULL OR Rating <= $3::int) " +
+		"AND ($4::timestamp IS NULL OR ReviewDate >= $4::timestamp) " +
+		"AND ($5::timestamp IS NULL OR ReviewDate <= $5::timestamp) " +
+		"AND ($6::timestamp IS NULL OR (ReviewDate, ProductReviewID) < ($6::timestamp, $7::int)) " +
+		"ORDER BY ReviewDate DESC, ProductReviewID DESC LIMIT $8")
+	if err != nil {
+		return nil, err
+	}
+	statements["ListApprovedReviews"] = listReviewsStmnt
+
+	// Counts a product's approved reviews matching the same filters as the listing
+	countReviewsStmnt, err := db.Prepare("SELECT COUNT(*) FROM Production.ProductReview " +
+		"WHERE ProductID=$1 AND Status='approved' " +
+		"AND ($2::int IS NULL OR Rating >= $2::int) AND ($3::int IS NULL OR Rating <= $3::int) " +
+		"AND ($4::timestamp IS NULL OR ReviewDate >= $4::timestamp) " +
+		"AND ($5::timestamp IS NULL OR ReviewDate <= $5::timestamp)")
+	if err != nil {
+		return nil, err
+	}
+	statements["CountApprovedReviews"] = countReviewsStmnt
+
+	// Fetches a single product by its id
+	getProductStmnt, err := db.Prepare("SELECT ProductID, Name, ProductNumber, MakeFlag, FinishedGoodsFlag, " +
+		"Color, SafetyStockLevel, ReorderPoint, StandardCost, ListPrice, Size, SizeUnitMeasureCode, " +
+		"WeightUnitMeasureCode, Weight, DaysToManufacture, ProductLine, Class, Style, ProductSubcategoryID, " +
+		"ProductModelID, SellStartDate, SellEndDate, DiscontinuedDate FROM Production.Product " +
+		"WHERE ProductID=$1")
+	if err != nil {
+		return nil, err
+	}
+	statements["GetProduct"] = getProductStmnt
+
+	// Counts a product's approved reviews by star rating
+	ratingCountsStmnt, err := db.Prepare("SELECT Rating, COUNT(*) FROM Production.ProductReview " +
+		"WHERE ProductID=$1 AND Status='approved' GROUP BY Rating")
+	if err != nil {
+		return nil, err
+	}
+	statements["GetRatingCounts"] = ratingCountsStmnt
+
 	// Adds new product review into the system
 	addReviewStmnt, err := db.Prepare("INSERT INTO Production.ProductReview " +
 		"(ProductID, ReviewerName, EmailAddress, Rating, Comments) " +
@@ -105,14 +206,40 @@ func prepareStatements(db *sql.DB) (statements map[string]*sql.Stmt, err error)
 	}
 	statements["AddReview"] = addReviewStmnt
 
-	// Updates existing product review in the system
+	// Updates existing product review in the system, sending it back through moderation
 	updateReviewStmnt, err := db.Prepare("UPDATE Production.ProductReview " +
-		"SET Rating=$2::smallint, Comments=$3 WHERE ProductReviewID=$1 RETURNING ProductReviewID")
+		"SET Rating=$2::smallint, Comments=$3, Status='pending', DecisionDate=NULL, DecisionReason=NULL, " +
+		"Decisions=NULL " +
+		"WHERE ProductReviewID=$1 RETURNING ProductReviewID")
 	if err != nil {
 		return nil, err
 	}
 	statements["UpdateReview"] = updateReviewStmnt
 
+	// Records the moderation decision made on a product review
+	setStatusStmnt, err := db.Prepare("UPDATE Production.ProductReview " +
+		"SET Status=$2, DecisionDate=NOW(), DecisionReason=$3, Decisions=$4::jsonb WHERE ProductReviewID=$1")
+	if err != nil {
+		return nil, err
+	}
+	statements["SetReviewStatus"] = setStatusStmnt
+
+	if err := prepareJobStatements(db, statements); err != nil {
+		return nil, err
+	}
+	if err := prepareDeadJobStatements(db, statements); err != nil {
+		return nil, err
+	}
+	if err := prepareOutboxStatements(db, statements); err != nil {
+		return nil, err
+	}
+	if err := prepareModerationStatements(db, statements); err != nil {
+		return nil, err
+	}
+	if err := preparePurchaseStatements(db, statements); err != nil {
+		return nil, err
+	}
+
 	return statements, nil
 }
 
@@ -174,17 +301,46 @@ func (w *Wrapper) Close() (err error) {
 	return nil
 }
 
-// UpsertReview handles insertions and new additions of product reviews to the database
-func (w *Wrapper) UpsertReview(productID int, name string, email string, rating int, comments string) (id int, err error) {
-	err = w.stmnts["GetReview"].QueryRow(productID, name, email).Scan(&id)
+// UpsertReview handles insertions and new additions of product reviews to the database.
+// The review is saved along with an outbox row holding payload, in a single transaction,
+// so the outbox relay is guaranteed to publish every review that's saved, in the priority
+// lane given by priority. Both priority and the caller are given the status the review had
+// before it was saved, which is empty for new reviews.
+func (w *Wrapper) UpsertReview(productID int, name string, email string, rating int, comments string,
+	payload []byte, priority func(previous ReviewStatus) int) (id int, previous ReviewStatus, err error) {
+	tx, err := w._db.Begin()
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return w.AddReview(productID, name, email, rating, comments)
+		return -1, "", fmt.Errorf("Unable to start transaction\nErr: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = tx.Stmt(w.stmnts["GetReview"]).QueryRow(productID, name, email).Scan(&id, &previous)
+	switch {
+	case err == sql.ErrNoRows:
+		err = tx.Stmt(w.stmnts["AddReview"]).QueryRow(productID, name, email, rating, comments).Scan(&id)
+		if err != nil {
+			return -1, "", fmt.Errorf("Unable to add review\nErr: %v", err)
+		}
+	case err != nil:
+		return -1, "", err
+	default:
+		err = tx.Stmt(w.stmnts["UpdateReview"]).QueryRow(id, rating, comments).Scan(&id)
+		if err != nil {
+			return -1, "", fmt.Errorf("Unable to update review\nErr: %v", err)
 		}
-		return -1, err
 	}
 
-	return w.UpdateReview(id, rating, comments)
+	if _, err = tx.Stmt(w.stmnts["AddOutbox"]).Exec(id, string(payload), priority(previous)); err != nil {
+		return -1, "", fmt.Errorf("Unable to add review to outbox\nErr: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return -1, "", fmt.Errorf("Unable to commit review\nErr: %v", err)
+	}
+	return id, previous, nil
 }
 
 // AddReview adds a new product review to the database
@@ -205,3 +361,136 @@ func (w *Wrapper) UpdateReview(reviewID int, rating int, comments string) (id in
 	}
 	return id, nil
 }
+
+// SetReviewStatus records the moderation decision made on a product review, and why it was made.
+// Decisions holds the json details of how each reviewer decided, and may be nil.
+func (w *Wrapper) SetReviewStatus(reviewID int, status ReviewStatus, reason string, decisions []byte) error {
+	var details *string
+	if decisions != nil {
+		s := string(decisions)
+		details = &s
+	}
+	res, err := w.stmnts["SetReviewStatus"].Exec(reviewID, string(status), reason, details)
+	if err != nil {
+		return fmt.Errorf("Unable to set review status\nErr: %v", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetReviewByID fetches the product review with the given id, returning ErrNotFound if there is none
+func (w *Wrapper) GetReviewByID(reviewID int) (*ProductReviewRow, error) {
+	var row ProductReviewRow
+	var decisions []byte // Decisions is null until a review is decided, which a RawMessage can't hold
+	err := w.stmnts["GetReviewByID"].QueryRow(reviewID).Scan(&row.ProductReviewID, &row.ProductID,
+		&row.ReviewerName, &row.ReviewDate, &row.EmailAddress, &row.Rating, &row.Comments,
+		&row.ModifiedDate, &row.Status,
+		&row.DecisionDate, &row.DecisionReason, &decisions, &row.VerifiedPurchase)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("Unable to get review\nErr: %v", err)
+	}
+	if decisions != nil {
+		row.Decisions = decisions
+	}
+	return &row, nil
+}
+
+// ListApprovedReviews lists up to limit approved reviews matching the filter, newest first.
+// If after is set, the listing starts with the review following it.
+func (w *Wrapper) ListApprovedReviews(filter ReviewFilter, after *ReviewCursor, limit int) ([]ProductReviewRow, error) {
+	var afterDate *time.Time
+	var afterID *int
+	if after != nil {
+		afterDate, afterID = &after.ReviewDate, &after.ProductReviewID
+	}
+
+	rows, err := w.stmnts["ListApprovedReviews"].Query(filter.ProductID, filter.MinRating, filter.MaxRating,
+		filter.Since, filter.Until, afterDate, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list reviews\nErr: %v", err)
+	}
+	defer rows.Close()
+
+	reviews := []ProductReviewRow{}
+	for rows.Next() {
+		var row ProductReviewRow
+		var decisions []byte
+		err := rows.Scan(&row.ProductReviewID, &row.ProductID, &row.ReviewerName, &row.ReviewDate,
+			&row.EmailAddress, &row.Rating, &row.Comments, &row.ModifiedDate, &row.Status,
+			&row.DecisionDate, &row.DecisionReason, &decisions, &row.VerifiedPurchase)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read review\nErr: %v", err)
+		}
+		if decisions != nil {
+			row.Decisions = decisions
+		}
+		reviews = append(reviews, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to list reviews\nErr: %v", err)
+	}
+
+	return reviews, nil
+}
+
+// CountApprovedReviews counts all of the approved reviews matching the filter
+func (w *Wrapper) CountApprovedReviews(filter ReviewFilter) (count int, err error) {
+	err = w.stmnts["CountApprovedReviews"].QueryRow(filter.ProductID, filter.MinRating, filter.MaxRating,
+		filter.Since, filter.Until).Scan(&count)
+	if err != nil {
+		return -1, fmt.Errorf("Unable to count reviews\nErr: %v", err)
+	}
+	return count, nil
+}
+
+// GetProduct fetches the product with the given id, returning ErrNotFound if there is none
+func (w *Wrapper) GetProduct(productID int) (*ProductRow, error) {
+	var row ProductRow
+	err := w.stmnts["GetProduct"].QueryRow(productID).Scan(&row.ProductID, &row.Name, &row.ProductNumber,
+		&row.MakeFlag, &row.FinishedGoodsFlag, &row.Color, &row.SafetyStockLevel, &row.ReorderPoint,
+		&row.StandardCost, &row.ListPrice, &row.Size, &row.SizeUnitMeasureCode, &row.WeightUnitMeasureCode,
+		&row.Weight, &row.DaysToManufacture, &row.ProductLine, &row.Class, &row.Style,
+		&row.ProductSubcategoryID, &row.ProductModelID, &row.SellStartDate, &row.SellEndDate,
+		&row.DiscontinuedDate)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("Unable to get product\nErr: %v", err)
+	}
+	return &row, nil
+}
+
+// GetRatingSummary aggregates the ratings of the product's approved reviews
+func (w *Wrapper) GetRatingSummary(productID int) (*RatingSummary, error) {
+	rows, err := w.stmnts["GetRatingCounts"].Query(productID)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get rating summary\nErr: %v", err)
+	}
+	defer rows.Close()
+
+	summary := RatingSummary{Histogram: map[int]int{1: 0, 2: 0, 3: 0, 4: 0, 5: 0}}
+	total := 0
+	for rows.Next() {
+		var rating, count int
+		if err := rows.Scan(&rating, &count); err != nil {
+			return nil, fmt.Errorf("Unable to read rating count\nErr: %v", err)
+		}
+		summary.Histogram[rating] = count
+		summary.Count += count
+		total += rating * count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to get rating summary\nErr: %v", err)
+	}
+
+	if summary.Count > 0 {
+		summary.Average = float64(total) / float64(summary.Count)
+	}
+	return &summary, nil
+}
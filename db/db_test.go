@@ -0,0 +1,87 @@
+package db
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"testing"
+	"time"
+)
+
+// reviewDriver is a database/sql driver answering every query with the same, undecided
+// review row, so scanning it goes through database/sql's conversions as it would for postgres
+type reviewDriver struct{}
+
+func (reviewDriver) Open(name string) (driver.Conn, error) { return reviewConn{}, nil }
+
+type reviewConn struct{}
+
+func (reviewConn) Prepare(query string) (driver.Stmt, error) { return reviewStmt{}, nil }
+func (reviewConn) Close() error                              { return nil }
+func (reviewConn) Begin() (driver.Tx, error)                 { return nil, driver.ErrSkip }
+
+type reviewStmt struct{}
+
+func (reviewStmt) Close() error  { return nil }
+func (reviewStmt) NumInput() int { return -1 }
+func (reviewStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+func (reviewStmt) Query(args []driver.Value) (driver.Rows, error) { return &reviewRows{}, nil }
+
+// reviewRows is a single pending review, with a null DecisionDate, DecisionReason, Decisions
+// and VerifiedPurchase
+type reviewRows struct {
+	done bool
+}
+
+func (r *reviewRows) Columns() []string {
+	return []string{"productreviewid", "productid", "reviewername", "reviewdate", "emailaddress", "rating",
+		"comments", "modifieddate", "status", "decisiondate", "decisionreason", "decisions", "verifiedpurchase"}
+}
+
+func (r *reviewRows) Close() error { return nil }
+
+func (r *reviewRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	now := time.Now()
+	copy(dest, []driver.Value{int64(1), int64(709), "John Smith", now, "john@fourthcoffee.com", int64(5),
+		"Great socks", now, "pending", nil, nil, nil, nil})
+	return nil
+}
+
+func init() {
+	sql.Register("reviews", reviewDriver{})
+}
+
+func TestReadUndecidedReviews(t *testing.T) {
+	conn, err := sql.Open("reviews", "")
+	if err != nil {
+		t.Fatalf("Unable to open database: %v", err)
+	}
+	stmnts, err := prepareStatements(conn)
+	if err != nil {
+		t.Fatalf("Unable to prepare statements: %v", err)
+	}
+	w := &Wrapper{_db: conn, stmnts: stmnts}
+	defer w.Close()
+
+	row, err := w.GetReviewByID(1)
+	if err != nil {
+		t.Fatalf("Unable to get a review with null decisions: %v", err)
+	}
+	if row.Decisions != nil || row.Status != StatusPending {
+		t.Fatalf("Expected a pending review without decisions, got %+v", row)
+	}
+
+	rows, err := w.ListApprovedReviews(ReviewFilter{ProductID: 709}, nil, 10)
+	if err != nil {
+		t.Fatalf("Unable to list reviews with null decisions: %v", err)
+	}
+	if len(rows) != 1 || rows[0].Decisions != nil {
+		t.Fatalf("Expected one review without decisions, got %+v", rows)
+	}
+}
@@ -0,0 +1,309 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// JobRow is the data in a row of the ProductReviewJob table in the database
+type JobRow struct {
+	ProductReviewJobID int
+	Payload            []byte
+	Priority           int
+	Attempts           int
+	State              string
+	RunAfter           time.Time
+	LeasedUntil        *time.Time
+	LeaseToken         *string // identifies the reservation, while the job is reserved
+	LastError          *string
+	FailedDate         *time.Time
+	CreatedDate        time.Time
+}
+
+// jobColumns lists the columns scanned into a JobRow, in order
+const jobColumns = "ProductReviewJobID, Payload, Priority, Attempts, State, RunAfter, LeasedUntil, LeaseToken, " +
+	"LastError, FailedDate, CreatedDate"
+
+// scanJob scans a row of jobColumns into a JobRow
+func scanJob(row interface {
+	Scan(dest ...interface{}) error
+}) (*JobRow, error) {
+	var job JobRow
+	err := row.Scan(&job.ProductReviewJobID, &job.Payload, &job.Priority, &job.Attempts, &job.State, &job.RunAfter,
+		&job.LeasedUntil, &job.LeaseToken, &job.LastError, &job.FailedDate, &job.CreatedDate)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// prepareJobStatements prepares the sql statements backing the postgres job queue
+func prepareJobStatements(db *sql.DB, statements map[string]*sql.Stmt) (err error) {
+	// Queues up a new job
+	enqueueStmnt, err := db.Prepare("INSERT INTO Production.ProductReviewJob (Payload, Priority) " +
+		"VALUES ($1::jsonb, $2) RETURNING ProductReviewJobID")
+	if err != nil {
+		return err
+	}
+	statements["EnqueueJob"] = enqueueStmnt
+
+	// Claims the oldest job in a priority lane that's ready to run under a fresh lease token,
+	// skipping past any another worker is claiming
+	reserveStmnt, err := db.Prepare("UPDATE Production.ProductReviewJob " +
+		"SET State='reserved', LeasedUntil=NOW() + $1 * INTERVAL '1 millisecond', " +
+		"LeaseToken=md5(random()::text || clock_timestamp()::text), ModifiedDate=NOW() " +
+		"WHERE ProductReviewJobID = (SELECT ProductReviewJobID FROM Production.ProductReviewJob " +
+		"WHERE State='ready' AND Priority=$2 AND RunAfter <= NOW() ORDER BY RunAfter, ProductReviewJobID " +
+		"LIMIT 1 FOR UPDATE SKIP LOCKED) RETURNING " + jobColumns)
+	if err != nil {
+		return err
+	}
+	statements["ReserveJob"] = reserveStmnt
+
+	// Removes a reserved job once it's been processed, if it's still reserved under the token
+	deleteStmnt, err := db.Prepare("DELETE FROM Production.ProductReviewJob " +
+		"WHERE ProductReviewJobID=$1 AND State='reserved' AND LeaseToken=$2")
+	if err != nil {
+		return err
+	}
+	statements["DeleteJob"] = deleteStmnt
+
+	// Hands a reserved job back to run again once its backoff has passed
+	retryStmnt, err := db.Prepare("UPDATE Production.ProductReviewJob " +
+		"SET State='ready', Attempts=Attempts + 1, RunAfter=NOW() + $3 * INTERVAL '1 millisecond', " +
+		"LeasedUntil=NULL, LeaseToken=NULL, LastError=$4, ModifiedDate=NOW() " +
+		"WHERE ProductReviewJobID=$1 AND State='reserved' AND LeaseToken=$2")
+	if err != nil {
+		return err
+	}
+	statements["RetryJob"] = retryStmnt
+
+	// Sets a reserved job aside for good
+	deadLetterStmnt, err := db.Prepare("UPDATE Production.ProductReviewJob " +
+		"SET State='dead', LeasedUntil=NULL, LeaseToken=NULL, LastError=$3, FailedDate=NOW(), ModifiedDate=NOW() " +
+		"WHERE ProductReviewJobID=$1 AND State='reserved' AND LeaseToken=$2")
+	if err != nil {
+		return err
+	}
+	statements["DeadLetterJob"] = deadLetterStmnt
+
+	// Hands a reserved job back untouched, to be reserved again straight away
+	releaseStmnt, err := db.Prepare("UPDATE Production.ProductReviewJob " +
+		"SET State='ready', LeasedUntil=NULL, LeaseToken=NULL, ModifiedDate=NOW() " +
+		"WHERE ProductReviewJobID=$1 AND State='reserved' AND LeaseToken=$2")
+	if err != nil {
+		return err
+	}
+	statements["ReleaseJob"] = releaseStmnt
+
+	// Lists reserved jobs whose lease has run out
+	expiredStmnt, err := db.Prepare("SELECT " + jobColumns + " FROM Production.ProductReviewJob " +
+		"WHERE State='reserved' AND LeasedUntil < NOW() ORDER BY LeasedUntil LIMIT $1")
+	if err != nil {
+		return err
+	}
+	statements["ExpiredJobs"] = expiredStmnt
+
+	return nil
+}
+
+// execReservedJob runs a statement that only applies to a job reserved under the given
+// lease token, returning ErrNotFound if the job isn't reserved under it (anymore)
+func (w *Wrapper) execReservedJob(name string, args ...interface{}) error {
+	res, err := w.stmnts[name].Exec(args...)
+	if err != nil {
+		return fmt.Errorf("Unable to update job\nErr: %v", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// EnqueueJob queues up a new job with the given json payload, in the given priority lane
+func (w *Wrapper) EnqueueJob(payload []byte, priority int) (id int, err error) {
+	err = w.stmnts["EnqueueJob"].QueryRow(string(payload), priority).Scan(&id)
+	if err != nil {
+		return -1, fmt.Errorf("Unable to enqueue job\nErr: %v", err)
+	}
+	return id, nil
+}
+
+// ReserveJob claims the oldest job in the given priority lane that's ready to run, leasing
+// it for the given duration under a new LeaseToken. It returns ErrNotFound if no job in
+// the lane is ready.
+func (w *Wrapper) ReserveJob(lease time.Duration, priority int) (*JobRow, error) {
+	job, err := scanJob(w.stmnts["ReserveJob"].QueryRow(int64(lease/time.Millisecond), priority))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("Unable to reserve job\nErr: %v", err)
+	}
+	return job, nil
+}
+
+// DeleteJob removes a job reserved under the lease token once it's been processed
+func (w *Wrapper) DeleteJob(jobID int, token string) error {
+	return w.execReservedJob("DeleteJob", jobID, token)
+}
+
+// RetryJob hands a job reserved under the lease token back to run again after the given
+// delay, incrementing its attempts
+func (w *Wrapper) RetryJob(jobID int, token string, delay time.Duration, reason string) error {
+	return w.execReservedJob("RetryJob", jobID, token, int64(delay/time.Millisecond), reason)
+}
+
+// DeadLetterJob sets a job reserved under the lease token aside for good, along with the reason
+func (w *Wrapper) DeadLetterJob(jobID int, token string, reason string) error {
+	return w.execReservedJob("DeadLetterJob", jobID, token, reason)
+}
+
+// ReleaseJob hands a job reserved under the lease token back, without counting an attempt,
+// so it's reserved again in its original place in line
+func (w *Wrapper) ReleaseJob(jobID int, token string) error {
+	return w.execReservedJob("ReleaseJob", jobID, token)
+}
+
+// ExpiredJobs lists up to limit reserved jobs whose lease has run out, longest expired first
+func (w *Wrapper) ExpiredJobs(limit int) ([]JobRow, error) {
+	rows, err := w.stmnts["ExpiredJobs"].Query(limit)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list expired jobs\nErr: %v", err)
+	}
+	defer rows.Close()
+
+	var jobs []JobRow
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read job\nErr: %v", err)
+		}
+		jobs = append(jobs, *job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to list expired jobs\nErr: %v", err)
+	}
+	return jobs, nil
+}
+
+// prepareDeadJobStatements prepares the sql statements for inspecting, replaying and
+// purging dead lettered jobs
+func prepareDeadJobStatements(db *sql.DB, statements map[string]*sql.Stmt) (err error) {
+	// Lists dead lettered jobs, most recently failed first
+	listDeadStmnt, err := db.Prepare("SELECT " + jobColumns + " FROM Production.ProductReviewJob " +
+		"WHERE State='dead' ORDER BY FailedDate DESC, ProductReviewJobID DESC OFFSET $1 LIMIT $2")
+	if err != nil {
+		return err
+	}
+	statements["ListDeadJobs"] = listDeadStmnt
+
+	// Fetches a single dead lettered job
+	getDeadStmnt, err := db.Prepare("SELECT " + jobColumns + " FROM Production.ProductReviewJob " +
+		"WHERE ProductReviewJobID=$1 AND State='dead'")
+	if err != nil {
+		return err
+	}
+	statements["GetDeadJob"] = getDeadStmnt
+
+	// Hands a dead lettered job back to run straight away, with its attempts reset
+	replayStmnt, err := db.Prepare("UPDATE Production.ProductReviewJob " +
+		"SET State='ready', Attempts=0, RunAfter=NOW(), LastError=NULL, FailedDate=NULL, ModifiedDate=NOW() " +
+		"WHERE ProductReviewJobID=$1 AND State='dead'")
+	if err != nil {
+		return err
+	}
+	statements["ReplayDeadJob"] = replayStmnt
+
+	// Discards a dead lettered job for good
+	purgeStmnt, err := db.Prepare("DELETE FROM Production.ProductReviewJob " +
+		"WHERE ProductReviewJobID=$1 AND State='dead'")
+	if err != nil {
+		return err
+	}
+	statements["PurgeDeadJob"] = purgeStmnt
+
+	// Discards every dead lettered job for good
+	purgeAllStmnt, err := db.Prepare("DELETE FROM Production.ProductReviewJob WHERE State='dead'")
+	if err != nil {
+		return err
+	}
+	statements["PurgeDeadJobs"] = purgeAllStmnt
+
+	return nil
+}
+
+// ListDeadJobs lists up to limit dead lettered jobs, most recently failed first, skipping
+// the first offset of them
+func (w *Wrapper) ListDeadJobs(offset int, limit int) ([]JobRow, error) {
+	rows, err := w.stmnts["ListDeadJobs"].Query(offset, limit)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list dead jobs\nErr: %v", err)
+	}
+	defer rows.Close()
+
+	var jobs []JobRow
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read job\nErr: %v", err)
+		}
+		jobs = append(jobs, *job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to list dead jobs\nErr: %v", err)
+	}
+	return jobs, nil
+}
+
+// GetDeadJob fetches the dead lettered job with the given id, returning ErrNotFound if
+// there is none
+func (w *Wrapper) GetDeadJob(jobID int) (*JobRow, error) {
+	job, err := scanJob(w.stmnts["GetDeadJob"].QueryRow(jobID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("Unable to get dead job\nErr: %v", err)
+	}
+	return job, nil
+}
+
+// ReplayDeadJob hands a dead lettered job back to be reserved straight away, with its
+// attempts reset, returning ErrNotFound if it isn't dead lettered
+func (w *Wrapper) ReplayDeadJob(jobID int) error {
+	return w.execDeadJob("ReplayDeadJob", jobID)
+}
+
+// PurgeDeadJob discards a dead lettered job for good, returning ErrNotFound if it isn't
+// dead lettered
+func (w *Wrapper) PurgeDeadJob(jobID int) error {
+	return w.execDeadJob("PurgeDeadJob", jobID)
+}
+
+// execDeadJob runs a statement that only applies to a dead lettered job, returning
+// ErrNotFound if the job isn't dead lettered
+func (w *Wrapper) execDeadJob(name string, jobID int) error {
+	res, err := w.stmnts[name].Exec(jobID)
+	if err != nil {
+		return fmt.Errorf("Unable to update dead job\nErr: %v", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// PurgeDeadJobs discards every dead lettered job for good, returning how many there were
+func (w *Wrapper) PurgeDeadJobs() (purged int, err error) {
+	res, err := w.stmnts["PurgeDeadJobs"].Exec()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to purge dead jobs\nErr: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to purge dead jobs\nErr: %v", err)
+	}
+	return int(n), nil
+}
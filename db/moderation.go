@@ -0,0 +1,58 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Kinds of moderation terms, matching the LanguageReviewer's terms of the same names
+const (
+	TermBlacklist = "blacklist"
+	TermAllowlist = "allowlist"
+	TermSubstring = "substring"
+	TermWildcard  = "wildcard"
+	TermPattern   = "pattern"
+)
+
+// ModerationTermRow is the data in a row of the ModerationTerm table in the database
+type ModerationTermRow struct {
+	ModerationTermID int
+	Term             string
+	Kind             string
+	CultureID        *string // nil for terms looked for in every language
+}
+
+// prepareModerationStatements prepares the sql statements backing the moderation lexicon
+func prepareModerationStatements(db *sql.DB, statements map[string]*sql.Stmt) (err error) {
+	// Lists every moderation term, in a stable order so the lexicon they make up is too
+	listTermsStmnt, err := db.Prepare("SELECT ModerationTermID, Term, Kind, TRIM(CultureID) " +
+		"FROM Production.ModerationTerm ORDER BY CultureID NULLS FIRST, Kind, ModerationTermID")
+	if err != nil {
+		return err
+	}
+	statements["ListModerationTerms"] = listTermsStmnt
+
+	return nil
+}
+
+// ListModerationTerms lists every term in the moderation lexicon
+func (w *Wrapper) ListModerationTerms() ([]ModerationTermRow, error) {
+	rows, err := w.stmnts["ListModerationTerms"].Query()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list moderation terms\nErr: %v", err)
+	}
+	defer rows.Close()
+
+	var terms []ModerationTermRow
+	for rows.Next() {
+		var row ModerationTermRow
+		if err := rows.Scan(&row.ModerationTermID, &row.Term, &row.Kind, &row.CultureID); err != nil {
+			return nil, fmt.Errorf("Unable to read moderation term\nErr: %v", err)
+		}
+		terms = append(terms, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to list moderation terms\nErr: %v", err)
+	}
+	return terms, nil
+}
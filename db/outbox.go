@@ -0,0 +1,101 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// OutboxRow is the data in a row of the ProductReviewOutbox table in the database
+type OutboxRow struct {
+	ProductReviewOutboxID int
+	ProductReviewID       int
+	Payload               []byte
+	Priority              int
+	Attempts              int
+	LastError             *string
+	CreatedDate           time.Time
+}
+
+// prepareOutboxStatements prepares the sql statements backing the review outbox
+func prepareOutboxStatements(db *sql.DB, statements map[string]*sql.Stmt) (err error) {
+	// Adds a review to the outbox; only ever run in the transaction that saves the review
+	addOutboxStmnt, err := db.Prepare("INSERT INTO Production.ProductReviewOutbox " +
+		"(ProductReviewID, Payload, Priority) VALUES ($1, $2::jsonb, $3)")
+	if err != nil {
+		return err
+	}
+	statements["AddOutbox"] = addOutboxStmnt
+
+	// Claims the oldest unsent rows for a relay to publish, skipping past any another relay holds
+	claimOutboxStmnt, err := db.Prepare("UPDATE Production.ProductReviewOutbox " +
+		"SET ClaimedUntil=NOW() + $1 * INTERVAL '1 millisecond' " +
+		"WHERE ProductReviewOutboxID IN (SELECT ProductReviewOutboxID FROM Production.ProductReviewOutbox " +
+		"WHERE SentDate IS NULL AND (ClaimedUntil IS NULL OR ClaimedUntil < NOW()) " +
+		"ORDER BY ProductReviewOutboxID LIMIT $2 FOR UPDATE SKIP LOCKED) " +
+		"RETURNING ProductReviewOutboxID, ProductReviewID, Payload, Priority, Attempts, LastError, CreatedDate")
+	if err != nil {
+		return err
+	}
+	statements["ClaimOutbox"] = claimOutboxStmnt
+
+	// Marks a row as published
+	markSentStmnt, err := db.Prepare("UPDATE Production.ProductReviewOutbox " +
+		"SET SentDate=NOW(), ClaimedUntil=NULL WHERE ProductReviewOutboxID=$1")
+	if err != nil {
+		return err
+	}
+	statements["MarkOutboxSent"] = markSentStmnt
+
+	// Releases a row that couldn't be published, so it's tried again
+	markFailedStmnt, err := db.Prepare("UPDATE Production.ProductReviewOutbox " +
+		"SET Attempts=Attempts + 1, LastError=$2, ClaimedUntil=NULL WHERE ProductReviewOutboxID=$1")
+	if err != nil {
+		return err
+	}
+	statements["MarkOutboxFailed"] = markFailedStmnt
+
+	return nil
+}
+
+// ClaimOutbox claims up to limit of the oldest unsent outbox rows for the given lease, so
+// other relays leave them alone while they're published. Rows that aren't marked sent or
+// failed before the lease runs out are handed to the next relay to ask.
+func (w *Wrapper) ClaimOutbox(lease time.Duration, limit int) ([]OutboxRow, error) {
+	rows, err := w.stmnts["ClaimOutbox"].Query(int64(lease/time.Millisecond), limit)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to claim outbox rows\nErr: %v", err)
+	}
+	defer rows.Close()
+
+	var claimed []OutboxRow
+	for rows.Next() {
+		var row OutboxRow
+		err := rows.Scan(&row.ProductReviewOutboxID, &row.ProductReviewID, &row.Payload, &row.Priority,
+			&row.Attempts, &row.LastError, &row.CreatedDate)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read outbox row\nErr: %v", err)
+		}
+		claimed = append(claimed, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to claim outbox rows\nErr: %v", err)
+	}
+	return claimed, nil
+}
+
+// MarkOutboxSent marks an outbox row as published to the review queue
+func (w *Wrapper) MarkOutboxSent(outboxID int) error {
+	if _, err := w.stmnts["MarkOutboxSent"].Exec(outboxID); err != nil {
+		return fmt.Errorf("Unable to mark outbox row %d sent\nErr: %v", outboxID, err)
+	}
+	return nil
+}
+
+// MarkOutboxFailed releases an outbox row that couldn't be published, recording why
+func (w *Wrapper) MarkOutboxFailed(outboxID int, reason string) error {
+	if _, err := w.stmnts["MarkOutboxFailed"].Exec(outboxID, reason); err != nil {
+		return fmt.Errorf("Unable to mark outbox row %d failed\nErr: %v", outboxID, err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// preparePurchaseStatements prepares the sql statements verifying that reviewers bought what they review
+func preparePurchaseStatements(db *sql.DB, statements map[string]*sql.Stmt) (err error) {
+	// Checks for an order of the product by the customer with the email address
+	hasPurchasedStmnt, err := db.Prepare("SELECT EXISTS (SELECT 1 FROM Person.EmailAddress e " +
+		"JOIN Sales.Customer c ON c.PersonID=e.BusinessEntityID " +
+		"JOIN Sales.SalesOrderHeader h ON h.CustomerID=c.CustomerID " +
+		"JOIN Sales.SalesOrderDetail d ON d.SalesOrderID=h.SalesOrderID " +
+		"WHERE lower(e.EmailAddress)=lower($1) AND d.ProductID=$2)")
+	if err != nil {
+		return err
+	}
+	statements["HasPurchased"] = hasPurchasedStmnt
+
+	// Records whether a review's author bought the product
+	setVerifiedStmnt, err := db.Prepare("UPDATE Production.ProductReview SET VerifiedPurchase=$2 " +
+		"WHERE ProductReviewID=$1")
+	if err != nil {
+		return err
+	}
+	statements["SetVerifiedPurchase"] = setVerifiedStmnt
+
+	return nil
+}
+
+// HasPurchased checks whether the customer with the given email address has ever ordered the product
+func (w *Wrapper) HasPurchased(email string, productID int) (bool, error) {
+	var purchased bool
+	if err := w.stmnts["HasPurchased"].QueryRow(email, productID).Scan(&purchased); err != nil {
+		return false, fmt.Errorf("Unable to look up purchases of product %d\nErr: %v", productID, err)
+	}
+	return purchased, nil
+}
+
+// SetVerifiedPurchase records whether the author of a product review bought the product
+func (w *Wrapper) SetVerifiedPurchase(reviewID int, verified bool) error {
+	res, err := w.stmnts["SetVerifiedPurchase"].Exec(reviewID, verified)
+	if err != nil {
+		return fmt.Errorf("Unable to record verified purchase for review %d\nErr: %v", reviewID, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -552,10 +552,16 @@ CREATE SCHEMA Production
     Rating INT NOT NULL,
     Comments varchar(3850),
     ModifiedDate TIMESTAMP NOT NULL CONSTRAINT "DF_ProductReview_ModifiedDate" DEFAULT (NOW()),
+    Status varchar(20) NOT NULL CONSTRAINT "DF_ProductReview_Status" DEFAULT ('pending'),
+    DecisionDate TIMESTAMP NULL,
+    DecisionReason varchar(1024) NULL,
+    Decisions jsonb NULL,
+    VerifiedPurchase boolean NULL,
     UNIQUE (ProductID, EmailAddress),
     UNIQUE (ReviewerName, EmailAddress),
     CONSTRAINT "CK_EmailAddrValid" CHECK (EmailAddress ~* '^[A-Za-z0-9._%-]+@[A-Za-z0-9.-]+[.][A-Za-z]+$'),
-    CONSTRAINT "CK_ProductReview_Rating" CHECK (Rating BETWEEN 1 AND 5)
+    CONSTRAINT "CK_ProductReview_Rating" CHECK (Rating BETWEEN 1 AND 5),
+    CONSTRAINT "CK_ProductReview_Status" CHECK (Status IN ('pending', 'approved', 'rejected', 'needs_manual_review'))
   )
   CREATE TABLE ScrapReason(
     ScrapReasonID SERIAL NOT NULL, -- smallint
@@ -710,6 +716,9 @@ The Road-550-W frame is available in a variety of sizes and colors and has the s
 we think that after a test drive you''l find the quality and performance above and beyond . You''ll have a grin on your face and be itching to get out on the road for more. While designed for serious road racing, the Road-550-W would be an excellent choice for just about any terrain and 
 any level of experience. It''s a huge step in the right direction for female cyclists and well worth your consideration and hard-earned money.', '2013-11-15 00:00:00');
 
+-- the seeded reviews predate our moderation pipeline, so treat them as already approved
+UPDATE Production.ProductReview SET Status = 'approved';
+
 SELECT 'Copying data into Production.ScrapReason';
 \copy Production.ScrapReason FROM '/data/ScrapReason.csv' DELIMITER E'\t' CSV;
 SELECT 'Copying data into Production.TransactionHistory';
@@ -1543,6 +1552,11 @@ COMMENT ON TABLE Production.ProductReview IS 'Customer reviews of products they
   COMMENT ON COLUMN Production.ProductReview.EmailAddress IS 'Reviewer''s e-mail address.';
   COMMENT ON COLUMN Production.ProductReview.Rating IS 'Product rating given by the reviewer. Scale is 1 to 5 with 5 as the highest rating.';
   COMMENT ON COLUMN Production.ProductReview.Comments IS 'Reviewer''s comments';
+  COMMENT ON COLUMN Production.ProductReview.Status IS 'Moderation status of the review: pending, approved, rejected or needs_manual_review.';
+  COMMENT ON COLUMN Production.ProductReview.DecisionDate IS 'Date the moderation decision was made. Null while the review is pending.';
+  COMMENT ON COLUMN Production.ProductReview.DecisionReason IS 'Why the review was given its moderation status.';
+  COMMENT ON COLUMN Production.ProductReview.Decisions IS 'Each reviewer''s decision on the review, with the evidence and confidence behind it.';
+  COMMENT ON COLUMN Production.ProductReview.VerifiedPurchase IS 'Whether the reviewer ordered the product, going by their email address. Null until checked.';
 
 COMMENT ON TABLE Production.ProductSubcategory IS 'Product subcategories. See ProductCategory table.';
   COMMENT ON COLUMN Production.ProductSubcategory.ProductSubcategoryID IS 'Primary key for ProductSubcategory records.';
@@ -1998,6 +2012,81 @@ ALTER TABLE Production.ProductReview ADD
   CONSTRAINT "PK_ProductReview_IDFKey" FOREIGN KEY (ProductID)
   REFERENCES Production.Product(ProductID);
 
+-- Job queue for product reviews waiting on approval, for running without redis.
+-- Workers claim jobs with FOR UPDATE SKIP LOCKED, so they never block on each other.
+CREATE TABLE Production.ProductReviewJob(
+    ProductReviewJobID SERIAL NOT NULL,
+    Payload jsonb NOT NULL,
+    Priority smallint NOT NULL CONSTRAINT "DF_ProductReviewJob_Priority" DEFAULT (0),
+    Attempts INT NOT NULL CONSTRAINT "DF_ProductReviewJob_Attempts" DEFAULT (0),
+    State varchar(10) NOT NULL CONSTRAINT "DF_ProductReviewJob_State" DEFAULT ('ready'),
+    RunAfter TIMESTAMP NOT NULL CONSTRAINT "DF_ProductReviewJob_RunAfter" DEFAULT (NOW()),
+    LeasedUntil TIMESTAMP NULL,
+    LeaseToken char(32) NULL,
+    LastError varchar NULL,
+    FailedDate TIMESTAMP NULL,
+    CreatedDate TIMESTAMP NOT NULL CONSTRAINT "DF_ProductReviewJob_CreatedDate" DEFAULT (NOW()),
+    ModifiedDate TIMESTAMP NOT NULL CONSTRAINT "DF_ProductReviewJob_ModifiedDate" DEFAULT (NOW()),
+    CONSTRAINT "PK_ProductReviewJob_ProductReviewJobID" PRIMARY KEY (ProductReviewJobID),
+    CONSTRAINT "CK_ProductReviewJob_State" CHECK (State IN ('ready', 'reserved', 'dead'))
+);
+CREATE INDEX "IX_ProductReviewJob_State_Priority_RunAfter" ON Production.ProductReviewJob (State, Priority, RunAfter);
+COMMENT ON TABLE Production.ProductReviewJob IS 'Product reviews waiting on approval, when the review pipeline runs on the postgres queue.';
+  COMMENT ON COLUMN Production.ProductReviewJob.Priority IS 'Priority lane the job waits in: 1 high, 0 normal, -1 low.';
+  COMMENT ON COLUMN Production.ProductReviewJob.State IS 'ready to be reserved, reserved by a worker until LeasedUntil, or dead lettered.';
+  COMMENT ON COLUMN Production.ProductReviewJob.LeaseToken IS 'Identifies the current reservation, so a worker whose lease ran out cannot ack or retry the job once another worker has reserved it.';
+  COMMENT ON COLUMN Production.ProductReviewJob.RunAfter IS 'The job is not reserved before this time, so retries can wait out their backoff.';
+
+-- Outbox of product reviews waiting to be pushed onto the review queue. Rows are written in
+-- the same transaction as the review itself, so a saved review always reaches the approver.
+CREATE TABLE Production.ProductReviewOutbox(
+    ProductReviewOutboxID SERIAL NOT NULL,
+    ProductReviewID INT NOT NULL,
+    Payload jsonb NOT NULL,
+    Priority smallint NOT NULL CONSTRAINT "DF_ProductReviewOutbox_Priority" DEFAULT (0),
+    Attempts INT NOT NULL CONSTRAINT "DF_ProductReviewOutbox_Attempts" DEFAULT (0),
+    ClaimedUntil TIMESTAMP NULL,
+    LastError varchar NULL,
+    SentDate TIMESTAMP NULL,
+    CreatedDate TIMESTAMP NOT NULL CONSTRAINT "DF_ProductReviewOutbox_CreatedDate" DEFAULT (NOW()),
+    CONSTRAINT "PK_ProductReviewOutbox_ProductReviewOutboxID" PRIMARY KEY (ProductReviewOutboxID),
+    CONSTRAINT "FK_ProductReviewOutbox_ProductReview_ProductReviewID" FOREIGN KEY (ProductReviewID)
+      REFERENCES Production.ProductReview(ProductReviewID)
+);
+CREATE INDEX "IX_ProductReviewOutbox_Unsent" ON Production.ProductReviewOutbox (ProductReviewOutboxID) WHERE SentDate IS NULL;
+COMMENT ON TABLE Production.ProductReviewOutbox IS 'Product reviews waiting to be published to the review queue by the outbox relay.';
+  COMMENT ON COLUMN Production.ProductReviewOutbox.Payload IS 'The review as submitted, published along with ProductReviewID.';
+  COMMENT ON COLUMN Production.ProductReviewOutbox.Priority IS 'Priority lane the review is queued in: 1 high, 0 normal, -1 low.';
+  COMMENT ON COLUMN Production.ProductReviewOutbox.ClaimedUntil IS 'A relay is publishing the row until this time; other relays skip it meanwhile.';
+  COMMENT ON COLUMN Production.ProductReviewOutbox.SentDate IS 'Date the row was published to the review queue. Null until then.';
+
+-- Terms the language reviewer looks for in product reviews. approverd reloads them while it
+-- runs, so moderators can change them without a restart.
+CREATE TABLE Production.ModerationTerm(
+    ModerationTermID SERIAL NOT NULL,
+    Term varchar(256) NOT NULL,
+    Kind varchar(10) NOT NULL CONSTRAINT "DF_ModerationTerm_Kind" DEFAULT ('blacklist'),
+    CultureID char(6) NULL,
+    ModifiedDate TIMESTAMP NOT NULL CONSTRAINT "DF_ModerationTerm_ModifiedDate" DEFAULT (NOW()),
+    CONSTRAINT "PK_ModerationTerm_ModerationTermID" PRIMARY KEY (ModerationTermID),
+    CONSTRAINT "CK_ModerationTerm_Kind" CHECK (Kind IN ('blacklist', 'allowlist', 'substring', 'wildcard', 'pattern')),
+    CONSTRAINT "UQ_ModerationTerm_Term_Kind_CultureID" UNIQUE (Term, Kind, CultureID),
+    CONSTRAINT "FK_ModerationTerm_Culture_CultureID" FOREIGN KEY (CultureID)
+      REFERENCES Production.Culture(CultureID)
+);
+COMMENT ON TABLE Production.ModerationTerm IS 'Terms the language reviewer looks for in product reviews.';
+  COMMENT ON COLUMN Production.ModerationTerm.Kind IS 'blacklist words and phrases, allowlist exceptions to them, substrings matched within words, wildcard globs or regex patterns.';
+  COMMENT ON COLUMN Production.ModerationTerm.CultureID IS 'Language of the reviews the term is looked for in. Null for every language.';
+
+-- Looks up customers by the email address they review with, to verify their purchases
+CREATE INDEX "IX_EmailAddress_LowerEmailAddress" ON Person.EmailAddress (lower(EmailAddress));
+
+INSERT INTO Production.ModerationTerm (Term, Kind) VALUES
+  ('fee', 'blacklist'),
+  ('nee', 'blacklist'),
+  ('cruul', 'blacklist'),
+  ('leent', 'blacklist');
+
 ALTER TABLE Production.ProductSubcategory ADD
     CONSTRAINT "PK_ProductSubcategory_ProductSubcategoryID" PRIMARY KEY
     (ProductSubcategoryID);
@@ -0,0 +1,386 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Queues of a WorkerPool that jobs can be peeked at in, or drained from
+const (
+	ReqJobs   = "req"   // waiting in ReqQueue, or the Stream in StreamMode, to be reserved
+	ProcJobs  = "proc"  // reserved, and being processed
+	RetryJobs = "retry" // waiting out their backoff in RetryQueue
+)
+
+// QueueDepths counts the jobs in each of a WorkerPool's queues
+type QueueDepths struct {
+	Req   map[Priority]int // by priority lane
+	Proc  int
+	Retry int
+	Dead  int
+}
+
+// Depths counts the jobs in each queue. In StreamMode, Req counts the entries that
+// haven't been delivered to a consumer yet, and Proc the ones pending for a consumer.
+func (w *WorkerPool) Depths() (*QueueDepths, error) {
+	c := w.pool.Get()
+	defer c.Close()
+
+	depths := QueueDepths{Req: make(map[Priority]int)}
+	var err error
+	for _, p := range lanes {
+		if w.Mode == StreamMode {
+			var pending int
+			depths.Req[p], pending, err = w.laneDepth(c, laneKey(w.Stream, p))
+			depths.Proc += pending
+		} else {
+			depths.Req[p], err = redis.Int(c.Do("LLEN", laneKey(w.ReqQueue, p)))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to count %s priority jobs\nError: %v", p, err)
+		}
+	}
+
+	if w.Mode != StreamMode {
+		if depths.Proc, err = redis.Int(c.Do("LLEN", w.ProcQueue)); err != nil {
+			return nil, fmt.Errorf("Unable to count jobs being processed\nError: %v", err)
+		}
+	}
+	if depths.Retry, err = redis.Int(c.Do("ZCARD", w.RetryQueue)); err != nil {
+		return nil, fmt.Errorf("Unable to count jobs waiting on a retry\nError: %v", err)
+	}
+	if depths.Dead, err = redis.Int(c.Do("LLEN", w.DeadLetterQueue)); err != nil {
+		return nil, fmt.Errorf("Unable to count dead letters\nError: %v", err)
+	}
+	return &depths, nil
+}
+
+// laneDepth counts the entries of a lane stream that are waiting to be delivered, and
+// the ones pending for a consumer
+func (w *WorkerPool) laneDepth(c redis.Conn, stream string) (waiting int, pending int, err error) {
+	length, err := redis.Int(c.Do("XLEN", stream))
+	if err != nil {
+		return 0, 0, err
+	}
+	summary, err := redis.Values(c.Do("XPENDING", stream, w.Group))
+	if isRedisErr(err, "NOGROUP") {
+		return length, 0, nil
+	} else if err != nil || len(summary) == 0 {
+		return 0, 0, fmt.Errorf("Unexpected pending summary %v\nError: %v", summary, err)
+	}
+	if pending, err = redis.Int(summary[0], nil); err != nil {
+		return 0, 0, err
+	}
+	return length - pending, pending, nil
+}
+
+// PeekJobs returns up to count of the jobs in the given queue, ReqJobs, ProcJobs or
+// RetryJobs, without taking them off it. Jobs are listed in the order they'll be handled:
+// waiting jobs from the highest priority lane down, oldest first, jobs being processed
+// oldest first, and jobs waiting on a retry soonest due first.
+func (w *WorkerPool) PeekJobs(from string, count int) ([]*ProductReviewJob, error) {
+	c := w.pool.Get()
+	defer c.Close()
+
+	switch {
+	case from == ReqJobs && w.Mode == StreamMode:
+		var jobs []*ProductReviewJob
+		for _, p := range lanes {
+			if len(jobs) >= count {
+				break
+			}
+			lane, err := w.peekLane(c, laneKey(w.Stream, p), count-len(jobs))
+			if err != nil {
+				return nil, err
+			}
+			jobs = append(jobs, lane...)
+		}
+		return jobs, nil
+
+	case from == ReqJobs:
+		var ids []string
+		for _, p := range lanes {
+			if len(ids) >= count {
+				break
+			}
+			lane, err := redis.Strings(c.Do("LRANGE", laneKey(w.ReqQueue, p), -(count - len(ids)), -1))
+			if err != nil {
+				return nil, fmt.Errorf("Unable to peek at %s priority jobs\nError: %v", p, err)
+			}
+			ids = append(ids, reversed(lane)...)
+		}
+		return w.jobsByID(c, ids)
+
+	case from == ProcJobs && w.Mode == StreamMode:
+		pending, err := w.PendingEntries(count)
+		if err != nil {
+			return nil, err
+		}
+		var jobs []*ProductReviewJob
+		for _, entry := range pending {
+			if len(jobs) >= count {
+				break
+			}
+			// entries deleted while pending have no job left to show
+			if job, err := w.StreamJob(entry.Stream, entry.EntryID); err == nil {
+				jobs = append(jobs, job)
+			}
+		}
+		return jobs, nil
+
+	case from == ProcJobs:
+		ids, err := redis.Strings(c.Do("LRANGE", w.ProcQueue, -count, -1))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to peek at jobs being processed\nError: %v", err)
+		}
+		return w.jobsByID(c, reversed(ids))
+
+	case from == RetryJobs:
+		ids, err := redis.Strings(c.Do("ZRANGE", w.RetryQueue, 0, count-1))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to peek at jobs waiting on a retry\nError: %v", err)
+		}
+		return w.jobsByID(c, ids)
+	}
+	return nil, fmt.Errorf("Unknown queue %q, expected %s, %s or %s", from, ReqJobs, ProcJobs, RetryJobs)
+}
+
+// peekLane returns up to count of the entries in a lane stream that haven't been
+// delivered to a consumer yet, oldest first
+func (w *WorkerPool) peekLane(c redis.Conn, stream string, count int) ([]*ProductReviewJob, error) {
+	start := "-"
+	groups, err := redis.Values(c.Do("XINFO", "GROUPS", stream))
+	if isRedisErr(err, "ERR no such key") {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to look up consumer group %s\nError: %v", w.Group, err)
+	}
+	for _, g := range groups {
+		fields, err := redis.Values(g, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected consumer group info %v", g)
+		}
+		var name, lastID string
+		for i := 0; i+1 < len(fields); i += 2 {
+			key, _ := redis.String(fields[i], nil)
+			switch key {
+			case "name":
+				name, _ = redis.String(fields[i+1], nil)
+			case "last-delivered-id":
+				lastID, _ = redis.String(fields[i+1], nil)
+			}
+		}
+		if name == w.Group && lastID != "" {
+			start = "(" + lastID
+		}
+	}
+
+	entries, err := parseEntries(c.Do("XRANGE", stream, start, "+", "COUNT", count))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to peek at stream %s\nError: %v", stream, err)
+	}
+	jobs := make([]*ProductReviewJob, 0, len(entries))
+	for _, entry := range entries {
+		job, err := entryJob(stream, entry)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse stream entry %s\nError: %v", entry.ID, err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// jobsByID looks up the jobs with the given IDs in JobsKey, skipping any that are gone
+func (w *WorkerPool) jobsByID(c redis.Conn, ids []string) ([]*ProductReviewJob, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	args := []interface{}{w.JobsKey}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	payloads, err := redis.ByteSlices(c.Do("HMGET", args...))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read jobs\nError: %v", err)
+	}
+
+	jobs := make([]*ProductReviewJob, 0, len(ids))
+	for i, payload := range payloads {
+		if payload == nil {
+			continue
+		}
+		var job ProductReviewJob
+		if err := json.Unmarshal(payload, &job); err != nil {
+			return nil, fmt.Errorf("Unable to parse job %s\nError: %v", ids[i], err)
+		}
+		job.ID = ids[i]
+		jobs = append(jobs, &job)
+	}
+	return jobs, nil
+}
+
+// reversed returns ids in reverse order, e.g. to list a redis list oldest first
+func reversed(ids []string) []string {
+	r := make([]string, len(ids))
+	for i, id := range ids {
+		r[len(ids)-1-i] = id
+	}
+	return r
+}
+
+// StuckJobs lists the IDs of the jobs being processed whose lease ran out at least
+// grace ago, i.e. that the reaper should have retried by now had it been running. In
+// StreamMode, these are the entries that have been pending for longer than
+// LeaseTimeout plus grace.
+func (w *WorkerPool) StuckJobs(grace time.Duration) ([]string, error) {
+	if w.Mode == StreamMode {
+		pending, err := w.PendingEntries(claimBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		var ids []string
+		for _, entry := range pending {
+			if entry.Idle < w.LeaseTimeout+grace {
+				continue
+			}
+			if job, err := w.StreamJob(entry.Stream, entry.EntryID); err == nil {
+				ids = append(ids, job.ID)
+			}
+		}
+		return ids, nil
+	}
+
+	c := w.pool.Get()
+	defer c.Close()
+	expired := time.Now().Add(-grace).UnixNano() / int64(time.Millisecond)
+	ids, err := redis.Strings(c.Do("ZRANGEBYSCORE", leasesKey(w.ProcQueue), "-inf", expired))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list expired leases\nError: %v", err)
+	}
+	return ids, nil
+}
+
+// DrainJobs takes every job off the given queue, ReqJobs or RetryJobs, in the order
+// they'd have been handled, handing each one to save. A job save fails on is pushed back
+// onto the request queue, and draining stops there. Jobs are only taken from the queue
+// being drained, so a job a worker reserves, or that's promoted out of RetryQueue, between
+// being peeked at and taken is left where it went rather than drained as well.
+func (w *WorkerPool) DrainJobs(from string, save func(job *ProductReviewJob) error) (drained int, err error) {
+	if from != ReqJobs && from != RetryJobs {
+		return 0, fmt.Errorf("Unable to drain the %s queue, expected %s or %s", from, ReqJobs, RetryJobs)
+	}
+
+	for {
+		jobs, err := w.PeekJobs(from, promoteBatchSize)
+		if err != nil || len(jobs) == 0 {
+			return drained, err
+		}
+
+		taken := 0
+		for _, job := range jobs {
+			ok, err := w.takeJob(from, job)
+			if err != nil {
+				return drained, err
+			} else if !ok {
+				continue
+			}
+			taken++
+
+			if err := save(job); err != nil {
+				if pushErr := w.Push(job); pushErr != nil {
+					return drained, fmt.Errorf("Unable to save job %s, or push it back\nError: %v\nError: %v",
+						job.ID, err, pushErr)
+				}
+				return drained, err
+			}
+			drained++
+		}
+		if taken == 0 {
+			// every job we saw was reserved in the meantime, so there's nothing left to take
+			return drained, nil
+		}
+	}
+}
+
+// takeWaitingScript takes a job off its lane of the request queue, returning whether it
+// was still there.
+//
+// KEYS: lane, jobs hash. ARGV: job ID.
+var takeWaitingScript = redis.NewScript(2, `
+if redis.call('LREM', KEYS[1], 0, ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HDEL', KEYS[2], ARGV[1])
+return 1
+`)
+
+// takeRetryScript takes a job off the retry queue, returning whether it was still there.
+//
+// KEYS: retry queue, jobs hash. ARGV: job ID.
+var takeRetryScript = redis.NewScript(2, `
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HDEL', KEYS[2], ARGV[1])
+return 1
+`)
+
+// streamTakeScript deletes a job's entry from its lane stream, returning whether it was
+// still there and hadn't been delivered to a consumer yet.
+//
+// KEYS: lane stream, entries hash, jobs hash. ARGV: group, entry ID, job ID.
+var streamTakeScript = redis.NewScript(3, `
+local pending = redis.pcall('XPENDING', KEYS[1], ARGV[1], ARGV[2], ARGV[2], 1)
+if not pending.err and #pending > 0 then
+	return 0
+end
+if redis.call('XDEL', KEYS[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call('HDEL', KEYS[2], ARGV[3])
+redis.call('HDEL', KEYS[3], ARGV[3])
+return 1
+`)
+
+// takeJob takes a peeked at job off the queue it was peeked at in, returning whether it
+// was still waiting there
+func (w *WorkerPool) takeJob(from string, job *ProductReviewJob) (taken bool, err error) {
+	c := w.pool.Get()
+	defer c.Close()
+	var n int
+	switch {
+	case from == RetryJobs:
+		n, err = redis.Int(takeRetryScript.Do(c, w.RetryQueue, w.JobsKey, job.ID))
+	case w.Mode == StreamMode:
+		var stream, entry string
+		if stream, entry, err = w.entryOf(c, job); err != nil || entry == "" {
+			return false, err
+		}
+		n, err = redis.Int(streamTakeScript.Do(c, stream, entriesKey(w.Stream), w.JobsKey, w.Group, entry, job.ID))
+	default:
+		n, err = redis.Int(takeWaitingScript.Do(c, laneKey(w.ReqQueue, job.Priority), w.JobsKey, job.ID))
+	}
+	if err != nil {
+		return false, fmt.Errorf("Unable to take job %s\nError: %v", job.ID, err)
+	}
+	return n > 0, nil
+}
+
+// AddDeadLetter pushes a dead letter onto the dead letter queue as the most recently
+// failed, e.g. to restore one that was drained
+func (w *WorkerPool) AddDeadLetter(letter *DeadLetter) error {
+	b, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal dead letter\nError: %v", err)
+	}
+
+	c := w.pool.Get()
+	defer c.Close()
+	if _, err := c.Do("LPUSH", w.DeadLetterQueue, b); err != nil {
+		return fmt.Errorf("Unable to add dead letter\nError: %v", err)
+	}
+	return nil
+}
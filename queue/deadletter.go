@@ -0,0 +1,220 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// DeadLetter is a job that could not be processed, kept aside for inspection along with why it failed
+type DeadLetter struct {
+	Job      *ProductReviewJob `json:"job,omitempty"`
+	Payload  string            `json:"payload"`
+	Reason   string            `json:"reason"`
+	FailedAt time.Time         `json:"failedAt"`
+}
+
+// deadLetterScript moves a leased job from the processing queue onto the dead letter
+// queue, dropping its lease and payload; the dead letter carries the payload instead.
+// The job is only dead lettered if it's still reserved under the given lease token, so
+// it can't end up both dead and retried by the reaper.
+//
+// KEYS: processing queue, leases set, dead letter queue, jobs hash, lease tokens hash.
+// ARGV: job ID, dead letter, lease token.
+var deadLetterScript = redis.NewScript(5, leasedLua+`
+if not leased(KEYS[5], ARGV[1], ARGV[3]) then
+	return 0
+end
+local n = redis.call('LREM', KEYS[1], 0, ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[5], ARGV[1])
+if n > 0 then
+	redis.call('LPUSH', KEYS[3], ARGV[2])
+	redis.call('HDEL', KEYS[4], ARGV[1])
+end
+return n
+`)
+
+// replayScript moves a dead letter back onto its priority lane of the request queue as
+// its original job.
+//
+// KEYS: dead letter queue, jobs hash, signal, then the high, normal and low priority
+// lanes. ARGV: dead letter, job ID, job payload.
+var replayScript = redis.NewScript(6, laneLua+`
+local n = redis.call('LREM', KEYS[1], 1, ARGV[1])
+if n > 0 then
+	redis.call('HSET', KEYS[2], ARGV[2], ARGV[3])
+	redis.call('LPUSH', lane(ARGV[3]), ARGV[2])
+	redis.call('LPUSH', KEYS[3], 1)
+	redis.call('LTRIM', KEYS[3], 0, 0)
+end
+return n
+`)
+
+// deadLetter moves the job with the given ID, reserved under the lease token, out of the
+// processing queue and onto the dead letter queue, along with its payload
+func (w *WorkerPool) deadLetter(c redis.Conn, procQueue string, id string, token string, payload []byte,
+	reason string) error {
+	b, err := w.newDeadLetter(payload, reason)
+	if err != nil {
+		return err
+	}
+
+	_, err = deadLetterScript.Do(c, procQueue, leasesKey(procQueue), w.DeadLetterQueue, w.JobsKey,
+		tokensKey(procQueue), id, b, token)
+	if err != nil {
+		return fmt.Errorf("Unable to dead letter job\nError: %v", err)
+	}
+	return nil
+}
+
+// newDeadLetter marshals a dead letter for the job payload, failing now for the given reason
+func (w *WorkerPool) newDeadLetter(payload []byte, reason string) ([]byte, error) {
+	letter := DeadLetter{
+		Payload:  string(payload),
+		Reason:   reason,
+		FailedAt: time.Now().UTC(),
+	}
+	var job ProductReviewJob
+	if err := json.Unmarshal(payload, &job); err == nil {
+		letter.Job = &job
+	}
+	b, err := json.Marshal(&letter)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to marshal dead letter\nError: %v", err)
+	}
+	return b, nil
+}
+
+// DeadLetters lists the dead letters from index start through stop (inclusive, with
+// negative indexes counting from the end), most recently failed first
+func (w *WorkerPool) DeadLetters(start int, stop int) ([]DeadLetter, error) {
+	c := w.pool.Get()
+	defer c.Close()
+	raw, err := redis.ByteSlices(c.Do("LRANGE", w.DeadLetterQueue, start, stop))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list dead letters\nError: %v", err)
+	}
+
+	letters := make([]DeadLetter, len(raw))
+	for i, b := range raw {
+		if err := json.Unmarshal(b, &letters[i]); err != nil {
+			return nil, fmt.Errorf("Unable to read dead letter %d\nError: %v", start+i, err)
+		}
+	}
+	return letters, nil
+}
+
+// DeadLetterCount returns how many jobs sit in the dead letter queue
+func (w *WorkerPool) DeadLetterCount() (int, error) {
+	c := w.pool.Get()
+	defer c.Close()
+	n, err := redis.Int(c.Do("LLEN", w.DeadLetterQueue))
+	if err != nil {
+		return -1, fmt.Errorf("Unable to count dead letters\nError: %v", err)
+	}
+	return n, nil
+}
+
+// InspectDeadLetter returns the dead letter at the given index
+func (w *WorkerPool) InspectDeadLetter(index int) (*DeadLetter, error) {
+	c := w.pool.Get()
+	defer c.Close()
+	letter, _, err := w.deadLetterAt(c, index)
+	return letter, err
+}
+
+// deadLetterAt reads the dead letter at the given index, along with its raw bytes
+func (w *WorkerPool) deadLetterAt(c redis.Conn, index int) (*DeadLetter, []byte, error) {
+	b, err := redis.Bytes(c.Do("LINDEX", w.DeadLetterQueue, index))
+	if err == redis.ErrNil {
+		return nil, nil, fmt.Errorf("No dead letter at index %d", index)
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("Unable to read dead letter\nError: %v", err)
+	}
+
+	var letter DeadLetter
+	if err := json.Unmarshal(b, &letter); err != nil {
+		return nil, nil, fmt.Errorf("Unable to read dead letter %d\nError: %v", index, err)
+	}
+	return &letter, b, nil
+}
+
+// ReplayDeadLetter moves the dead letter at the given index back onto the request queue
+// (or the stream, in StreamMode), under its original job ID with its attempts counter
+// reset. Jobs that couldn't be parsed are replayed as they were, under a new ID.
+func (w *WorkerPool) ReplayDeadLetter(index int, reqQueue string) error {
+	c := w.pool.Get()
+	defer c.Close()
+	letter, b, err := w.deadLetterAt(c, index)
+	if err != nil {
+		return err
+	}
+
+	var id string
+	payload := []byte(letter.Payload)
+	if letter.Job != nil {
+		job := *letter.Job
+		job.Attempts = 0
+		if err := job.stamp(); err != nil {
+			return err
+		}
+		id = job.ID
+		if payload, err = json.Marshal(&job); err != nil {
+			return fmt.Errorf("Unable to marshal review job\nError: %v", err)
+		}
+	} else if id, err = newJobID(); err != nil {
+		return err
+	}
+
+	var n int
+	if w.Mode == StreamMode {
+		keys := append([]interface{}{w.DeadLetterQueue, entriesKey(w.Stream), signalKey(w.Stream)},
+			laneKeys(w.Stream)...)
+		n, err = redis.Int(streamReplayScript.Do(c, append(keys, b, id, payload)...))
+	} else {
+		keys := append([]interface{}{w.DeadLetterQueue, w.JobsKey, signalKey(reqQueue)}, laneKeys(reqQueue)...)
+		n, err = redis.Int(replayScript.Do(c, append(keys, b, id, payload)...))
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to replay dead letter\nError: %v", err)
+	} else if n != 1 {
+		return fmt.Errorf("Dead letter %d was removed before it could be replayed", index)
+	}
+	return nil
+}
+
+// PurgeDeadLetter discards the dead letter at the given index for good
+func (w *WorkerPool) PurgeDeadLetter(index int) error {
+	c := w.pool.Get()
+	defer c.Close()
+	_, b, err := w.deadLetterAt(c, index)
+	if err != nil {
+		return err
+	}
+
+	n, err := redis.Int(c.Do("LREM", w.DeadLetterQueue, 1, b))
+	if err != nil {
+		return fmt.Errorf("Unable to purge dead letter\nError: %v", err)
+	} else if n != 1 {
+		return fmt.Errorf("Dead letter %d was removed before it could be purged", index)
+	}
+	return nil
+}
+
+// PurgeDeadLetters discards every dead letter for good, returning how many there were
+func (w *WorkerPool) PurgeDeadLetters() (purged int, err error) {
+	c := w.pool.Get()
+	defer c.Close()
+
+	c.Send("MULTI")
+	c.Send("LLEN", w.DeadLetterQueue)
+	c.Send("DEL", w.DeadLetterQueue)
+	replies, err := redis.Values(c.Do("EXEC"))
+	if err != nil {
+		return 0, fmt.Errorf("Unable to purge dead letters\nError: %v", err)
+	}
+	return redis.Int(replies[0], nil)
+}
@@ -0,0 +1,134 @@
+package queue
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Priority decides which lane a job waits in. Workers drain higher priority lanes first,
+// but give lower ones a turn often enough that they're never starved.
+type Priority int
+
+// Priorities a job can be queued with. The zero value is PriorityNormal.
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+// lanes lists every priority lane, highest first
+var lanes = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+// lane returns the lane jobs of priority p wait in, clamping out of range priorities
+func (p Priority) lane() Priority {
+	if p > PriorityHigh {
+		return PriorityHigh
+	} else if p < PriorityLow {
+		return PriorityLow
+	}
+	return p
+}
+
+func (p Priority) String() string {
+	switch p.lane() {
+	case PriorityHigh:
+		return "high"
+	case PriorityLow:
+		return "low"
+	}
+	return "normal"
+}
+
+// ParsePriority parses a priority from its name: high, normal or low
+func ParsePriority(s string) (Priority, error) {
+	for _, p := range lanes {
+		if strings.EqualFold(s, p.String()) {
+			return p, nil
+		}
+	}
+	return PriorityNormal, fmt.Errorf("Unknown priority %q, expected high, normal or low", s)
+}
+
+// LaneWeights is how many turns each priority lane gets at being drained first, relative
+// to the others. With the default weights, out of every 7 jobs reserved while every lane
+// is busy, 4 are high priority, 2 normal and 1 low. A lane with no weight is only drained
+// when every lane with a weight is empty, and if no lane has a weight they're drained
+// strictly from the highest priority down.
+type LaneWeights map[Priority]int
+
+// DefaultLaneWeights provides sensible default weights for draining the priority lanes
+func DefaultLaneWeights() LaneWeights {
+	return LaneWeights{PriorityHigh: 4, PriorityNormal: 2, PriorityLow: 1}
+}
+
+// ParseLaneWeights parses lane weights written like "high=4,normal=2,low=1"
+func ParseLaneWeights(s string) (LaneWeights, error) {
+	weights := LaneWeights{}
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid lane weight %q, expected lane=weight", part)
+		}
+		p, err := ParsePriority(kv[0])
+		if err != nil {
+			return nil, err
+		}
+		w, err := strconv.Atoi(kv[1])
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("Invalid weight %q for the %s lane", kv[1], p)
+		}
+		weights[p] = w
+	}
+	return weights, nil
+}
+
+// laneScheduler decides the order in which a worker looks through the lanes for its next
+// job, using smooth weighted round robin so each lane gets first pick in proportion to
+// its weight, spread evenly rather than in bursts
+type laneScheduler struct {
+	mu     sync.Mutex
+	credit map[Priority]int
+}
+
+// order returns the lanes in the order to look through them for the next job: the lane
+// whose turn it is first, then the rest of the weighted lanes from the highest priority
+// down, then the lanes with no weight likewise
+func (s *laneScheduler) order(weights LaneWeights) []Priority {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.credit == nil {
+		s.credit = make(map[Priority]int)
+	}
+
+	var first Priority
+	total, found := 0, false
+	for _, p := range lanes {
+		if weights[p] <= 0 {
+			continue
+		}
+		s.credit[p] += weights[p]
+		total += weights[p]
+		if !found || s.credit[p] > s.credit[first] {
+			first, found = p, true
+		}
+	}
+	if !found {
+		return lanes
+	}
+	s.credit[first] -= total
+
+	order := []Priority{first}
+	for _, p := range lanes {
+		if p != first && weights[p] > 0 {
+			order = append(order, p)
+		}
+	}
+	for _, p := range lanes {
+		if weights[p] <= 0 {
+			order = append(order, p)
+		}
+	}
+	return order
+}
@@ -0,0 +1,165 @@
+package queue
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// leasedLua defines leased(tokens, id, token), which tells whether the job with the given
+// ID is still reserved under the given lease token. Jobs reserved before tokens were
+// recorded have none, and match an empty token.
+const leasedLua = `
+local function leased(tokens, id, token)
+	return (redis.call('HGET', tokens, id) or '') == token
+end
+`
+
+// ackScript removes a processed job from the processing queue along with its lease and
+// its payload, returning how many copies of the job were removed from the processing
+// queue. Nothing is removed unless the job is still reserved under the given lease token,
+// so a worker whose lease ran out can't ack the job once it's been handed to another.
+//
+// KEYS: processing queue, leases set, jobs hash, lease tokens hash. ARGV: job ID, lease token.
+var ackScript = redis.NewScript(4, leasedLua+`
+if not leased(KEYS[4], ARGV[1], ARGV[2]) then
+	return 0
+end
+local n = redis.call('LREM', KEYS[1], 0, ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+redis.call('HDEL', KEYS[4], ARGV[1])
+return n
+`)
+
+// leasesKey names the sorted set tracking the lease deadlines of the jobs in a processing queue
+func leasesKey(procQueue string) string {
+	return procQueue + ":leases"
+}
+
+// tokensKey names the hash of the lease token each job in a processing queue is reserved under
+func tokensKey(procQueue string) string {
+	return procQueue + ":tokens"
+}
+
+// newLeaseToken returns a random token identifying a single reservation of a job
+func newLeaseToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		return "", fmt.Errorf("Unable to generate lease token\nError: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// leaseDeadline returns the lease deadline of a job leased at t, as a sorted set score
+func (w *WorkerPool) leaseDeadline(t time.Time) int64 {
+	return t.Add(w.LeaseTimeout).UnixNano() / int64(time.Millisecond)
+}
+
+// ack removes the job with the given ID from the processing queue once it's been handled.
+// Acking a job that isn't reserved under the lease token anymore does nothing.
+func (w *WorkerPool) ack(c redis.Conn, procQueue string, id string, token string) error {
+	_, err := ackScript.Do(c, procQueue, leasesKey(procQueue), w.JobsKey, tokensKey(procQueue), id, token)
+	if err != nil {
+		return fmt.Errorf("Unable to remove job from queue\nError: %v", err)
+	}
+	return nil
+}
+
+// Reap schedules the jobs in the processing queue whose lease has expired for a retry,
+// incrementing their attempts counter. Jobs that made it into the processing queue
+// without a lease, e.g. because approverd crashed right after popping them, are given
+// one first, so they're reaped once it expires too. Jobs that have run out of
+// attempts are dead lettered instead.
+func (w *WorkerPool) Reap(procQueue string) (reaped int, err error) {
+	c := w.pool.Get()
+	defer c.Close()
+
+	inFlight, err := redis.Strings(c.Do("LRANGE", procQueue, 0, -1))
+	if err != nil {
+		return 0, fmt.Errorf("Unable to list jobs being processed\nError: %v", err)
+	}
+	deadline := w.leaseDeadline(time.Now())
+	for _, id := range inFlight {
+		if _, err := c.Do("ZADD", leasesKey(procQueue), "NX", deadline, id); err != nil {
+			return 0, fmt.Errorf("Unable to lease job\nError: %v", err)
+		}
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	expired, err := redis.Strings(c.Do("ZRANGEBYSCORE", leasesKey(procQueue), "-inf", now))
+	if err != nil {
+		return 0, fmt.Errorf("Unable to list expired leases\nError: %v", err)
+	}
+	for _, id := range expired {
+		// the job is only reaped under the lease that expired, in case it's acked meanwhile
+		token, err := redis.String(c.Do("HGET", tokensKey(procQueue), id))
+		if err != nil && err != redis.ErrNil {
+			return reaped, fmt.Errorf("Unable to read lease of job %s\nError: %v", id, err)
+		}
+
+		payload, err := redis.Bytes(c.Do("HGET", w.JobsKey, id))
+		if err == redis.ErrNil {
+			// the job was removed while it was being processed
+			if err := w.ack(c, procQueue, id, token); err != nil {
+				return reaped, err
+			}
+			continue
+		} else if err != nil {
+			return reaped, fmt.Errorf("Unable to read job %s\nError: %v", id, err)
+		}
+
+		var job ProductReviewJob
+		if err := json.Unmarshal(payload, &job); err != nil || job.Attempts+1 >= w.MaxAttempts {
+			reason := fmt.Sprintf("Lease expired after %d attempts", job.Attempts+1)
+			if err != nil {
+				reason = fmt.Sprintf("Lease expired on job that can't be parsed\nError: %v", err)
+			}
+			if err := w.deadLetter(c, procQueue, id, token, payload, reason); err != nil {
+				return reaped, err
+			}
+			continue
+		}
+
+		job.ID = id
+		job.leaseToken = token
+		retried, err := w.retry(c, procQueue, &job)
+		if err != nil {
+			return reaped, err
+		}
+		if retried {
+			reaped++
+		}
+	}
+
+	return reaped, nil
+}
+
+// runReaper reaps expired jobs every ReapInterval until ctx is cancelled.
+// A zero ReapInterval disables the reaper.
+func (w *WorkerPool) runReaper(ctx context.Context, reap func() (int, error)) {
+	if w.ReapInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(w.ReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := reap()
+			if err != nil {
+				log.Println("Reaper error:", err)
+			} else if n > 0 {
+				log.Printf("Reaper scheduled %d expired jobs for retry\n", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MemoryQueue is a Queue kept entirely in process memory. It's meant for tests and for
+// running receiverd and its processor together in one process: jobs are lost when the
+// process exits, and reserved jobs aren't leased, since a crashed worker takes the
+// whole queue down with it.
+type MemoryQueue struct {
+	// MaxAttempts is the max number of times to try processing a product review job
+	// before giving up on it and dead lettering it
+	MaxAttempts int
+
+	// Backoff is how long Nacked jobs wait before they're retried
+	Backoff Backoff
+
+	// LaneWeights is how often each priority lane gets first pick of the workers
+	LaneWeights LaneWeights
+	scheduler   laneScheduler
+
+	mu       sync.Mutex
+	ready    map[Priority][]*ProductReviewJob
+	reserved map[string]*ProductReviewJob
+	retries  []delayedJob
+	dead     []DeadLetter
+
+	// arrived is signalled whenever a job may have become ready
+	arrived chan struct{}
+}
+
+// delayedJob is a job waiting out its backoff before a retry
+type delayedJob struct {
+	job *ProductReviewJob
+	due time.Time
+}
+
+// NewMemoryQueue returns an empty in-memory queue
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{
+		MaxAttempts: 3,
+		Backoff:     DefaultBackoff(),
+		LaneWeights: DefaultLaneWeights(),
+		ready:       make(map[Priority][]*ProductReviewJob),
+		reserved:    make(map[string]*ProductReviewJob),
+		arrived:     make(chan struct{}, 1),
+	}
+}
+
+// signal wakes up a goroutine waiting in Reserve, if there is one
+func (q *MemoryQueue) signal() {
+	select {
+	case q.arrived <- struct{}{}:
+	default:
+	}
+}
+
+// Push queues up a copy of the job for processing
+func (q *MemoryQueue) Push(job *ProductReviewJob) error {
+	if err := job.stamp(); err != nil {
+		return err
+	}
+	j := *job
+
+	q.mu.Lock()
+	q.ready[j.Priority.lane()] = append(q.ready[j.Priority.lane()], &j)
+	q.mu.Unlock()
+	q.signal()
+	return nil
+}
+
+// Reserve hands out the oldest ready job in the lane whose turn it is, blocking until
+// one is ready or ctx is done
+func (q *MemoryQueue) Reserve(ctx context.Context) (*ProductReviewJob, error) {
+	for {
+		q.mu.Lock()
+		q.promote(time.Now())
+		if job := q.next(); job != nil {
+			q.reserved[job.ID] = job
+			more := q.readyLen() > 0
+			q.mu.Unlock()
+			if more {
+				q.signal()
+			}
+			return job, nil
+		}
+
+		// wake up for the next retry coming due, if there is one
+		var timer *time.Timer
+		var due <-chan time.Time
+		if len(q.retries) > 0 {
+			next := q.retries[0].due
+			for _, r := range q.retries[1:] {
+				if r.due.Before(next) {
+					next = r.due
+				}
+			}
+			timer = time.NewTimer(time.Until(next))
+			due = timer.C
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+		case <-q.arrived:
+		case <-due:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+	}
+}
+
+// next takes the oldest ready job out of the first lane with one, looking through the
+// lanes in the order the scheduler gives. The caller must hold mu.
+func (q *MemoryQueue) next() *ProductReviewJob {
+	if q.readyLen() == 0 {
+		return nil
+	}
+	for _, p := range q.scheduler.order(q.LaneWeights) {
+		if ready := q.ready[p]; len(ready) > 0 {
+			q.ready[p] = ready[1:]
+			return ready[0]
+		}
+	}
+	return nil
+}
+
+// readyLen returns how many jobs are ready across every lane. The caller must hold mu.
+func (q *MemoryQueue) readyLen() (n int) {
+	for _, ready := range q.ready {
+		n += len(ready)
+	}
+	return n
+}
+
+// promote moves the retries that are due onto their lane. The caller must hold mu.
+func (q *MemoryQueue) promote(now time.Time) {
+	waiting := q.retries[:0]
+	for _, r := range q.retries {
+		if r.due.After(now) {
+			waiting = append(waiting, r)
+		} else {
+			p := r.job.Priority.lane()
+			q.ready[p] = append(q.ready[p], r.job)
+		}
+	}
+	q.retries = waiting
+}
+
+// release takes the job with the given ID out of the reserved set, returning it, or nil
+// if it wasn't reserved. The caller must hold mu.
+func (q *MemoryQueue) release(id string) *ProductReviewJob {
+	job := q.reserved[id]
+	delete(q.reserved, id)
+	return job
+}
+
+// Ack removes a processed job from the queue
+func (q *MemoryQueue) Ack(job *ProductReviewJob) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.release(job.ID)
+	return nil
+}
+
+// Nack schedules a job that failed to process for a retry after its Backoff, or dead
+// letters it once it has made MaxAttempts attempts
+func (q *MemoryQueue) Nack(job *ProductReviewJob, reason string) error {
+	if job.Attempts+1 >= q.MaxAttempts {
+		return q.DeadLetter(job, fmt.Sprintf("Failed after %d attempts\nError: %v", job.Attempts+1, reason))
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	reserved := q.release(job.ID)
+	if reserved == nil {
+		return nil
+	}
+	reserved.Attempts++
+	q.retries = append(q.retries, delayedJob{job: reserved, due: time.Now().Add(q.Backoff.Delay(reserved.Attempts))})
+	q.signal()
+	return nil
+}
+
+// DeadLetter sets a reserved job aside for good, along with the reason
+func (q *MemoryQueue) DeadLetter(job *ProductReviewJob, reason string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	reserved := q.release(job.ID)
+	if reserved == nil {
+		return nil
+	}
+	j := *reserved
+	q.dead = append(q.dead, DeadLetter{Job: &j, Reason: reason, FailedAt: time.Now().UTC()})
+	return nil
+}
+
+// Release puts a reserved job back at the front of its lane
+func (q *MemoryQueue) Release(job *ProductReviewJob) error {
+	q.mu.Lock()
+	reserved := q.release(job.ID)
+	if reserved != nil {
+		p := reserved.Priority.lane()
+		q.ready[p] = append([]*ProductReviewJob{reserved}, q.ready[p]...)
+	}
+	q.mu.Unlock()
+	q.signal()
+	return nil
+}
+
+// Len returns how many jobs are ready, reserved and waiting on a retry
+func (q *MemoryQueue) Len() (ready int, reserved int, retrying int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.readyLen(), len(q.reserved), len(q.retries)
+}
+
+// DeadLetters returns the jobs that have been dead lettered, oldest first
+func (q *MemoryQueue) DeadLetters() []DeadLetter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]DeadLetter(nil), q.dead...)
+}
@@ -0,0 +1,258 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sjbodzo/review_system/db"
+	"github.com/sjbodzo/review_system/review"
+)
+
+// fakeRecorder records statuses in memory, failing every call while fail is set
+type fakeRecorder struct {
+	mu       sync.Mutex
+	statuses map[int]db.ReviewStatus
+	fail     bool
+}
+
+func (f *fakeRecorder) SetReviewStatus(reviewID int, status db.ReviewStatus, reason string, decisions []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail {
+		return fmt.Errorf("database is down")
+	}
+	f.statuses[reviewID] = status
+	return nil
+}
+
+func (f *fakeRecorder) status(reviewID int) db.ReviewStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.statuses[reviewID]
+}
+
+// waitFor polls cond until it holds, failing the test if it doesn't within a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProcessorWithMemoryQueue(t *testing.T) {
+	q := NewMemoryQueue()
+	recorder := &fakeRecorder{statuses: make(map[int]db.ReviewStatus)}
+	processor := NewProcessor(q, recorder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- processor.Run(ctx) }()
+
+	testcases := []struct {
+		reviewID int
+		comment  string
+		status   db.ReviewStatus
+	}{
+		{reviewID: 1, comment: "woOow. what a great product!", status: db.StatusApproved},
+		{reviewID: 2, comment: "Stick it right in your leent!", status: db.StatusRejected},
+	}
+	for _, tc := range testcases {
+		err := q.Push(&ProductReviewJob{ReviewID: tc.reviewID, Review: review.ProductReview{Review: tc.comment}})
+		if err != nil {
+			t.Fatalf("Unable to push review %d: %v", tc.reviewID, err)
+		}
+	}
+
+	for _, tc := range testcases {
+		waitFor(t, fmt.Sprint("review ", tc.reviewID), func() bool { return recorder.status(tc.reviewID) != "" })
+		if got := recorder.status(tc.reviewID); got != tc.status {
+			t.Fatalf("Review %d: expected status %s, got %s", tc.reviewID, tc.status, got)
+		}
+	}
+	waitFor(t, "jobs to be acked", func() bool {
+		ready, reserved, retrying := q.Len()
+		return ready+reserved+retrying == 0
+	})
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Expected Run to stop with %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestMemoryQueueRetriesThenDeadLetters(t *testing.T) {
+	q := NewMemoryQueue()
+	q.MaxAttempts = 2
+	q.Backoff = Backoff{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	recorder := &fakeRecorder{statuses: make(map[int]db.ReviewStatus), fail: true}
+	processor := NewProcessor(q, recorder)
+
+	q.Push(&ProductReviewJob{ReviewID: 7, Review: review.ProductReview{Review: "great product"}})
+	for attempt := 1; attempt <= q.MaxAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := processor.ProcessNext(ctx)
+		cancel()
+		if err == nil {
+			t.Fatalf("Attempt %d: expected the recorder's error, got none", attempt)
+		}
+	}
+
+	dead := q.DeadLetters()
+	if len(dead) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d", len(dead))
+	}
+	if dead[0].Job.ReviewID != 7 || dead[0].Job.Attempts != 1 {
+		t.Fatalf("Unexpected dead letter: %+v", dead[0].Job)
+	}
+	if ready, reserved, retrying := q.Len(); ready+reserved+retrying != 0 {
+		t.Fatalf("Expected an empty queue, got %d ready, %d reserved, %d retrying", ready, reserved, retrying)
+	}
+}
+
+func TestMemoryQueueJobIDs(t *testing.T) {
+	q := NewMemoryQueue()
+	job := &ProductReviewJob{ReviewID: 3, Review: review.ProductReview{Review: "great product"}}
+	if err := q.Push(job); err != nil {
+		t.Fatalf("Unable to push review: %v", err)
+	}
+	if job.ID == "" || job.EnqueuedAt.IsZero() {
+		t.Fatalf("Expected Push to stamp the job with an ID and enqueue time, got %+v", job)
+	}
+
+	reserved, err := q.Reserve(context.Background())
+	if err != nil || reserved == nil {
+		t.Fatalf("Expected to reserve the job, got %v and error %v", reserved, err)
+	}
+	if reserved.ID != job.ID {
+		t.Fatalf("Expected job %s to be reserved, got %s", job.ID, reserved.ID)
+	}
+
+	// a copy of the job carrying its ID is enough to ack it, and acking again is harmless
+	ack := &ProductReviewJob{ID: job.ID}
+	for i := 0; i < 2; i++ {
+		if err := q.Ack(ack); err != nil {
+			t.Fatalf("Ack %d: unexpected error %v", i+1, err)
+		}
+	}
+	if err := q.Nack(ack, "too late"); err != nil {
+		t.Fatalf("Expected Nack of an acked job to do nothing, got %v", err)
+	}
+	if ready, reserved, retrying := q.Len(); ready+reserved+retrying != 0 {
+		t.Fatalf("Expected an empty queue, got %d ready, %d reserved, %d retrying", ready, reserved, retrying)
+	}
+}
+
+func TestMemoryQueuePriorityLanes(t *testing.T) {
+	q := NewMemoryQueue()
+	for i := 0; i < 10; i++ {
+		for _, p := range []Priority{PriorityLow, PriorityNormal, PriorityHigh} {
+			if err := q.Push(&ProductReviewJob{ReviewID: i, Priority: p}); err != nil {
+				t.Fatalf("Unable to push review: %v", err)
+			}
+		}
+	}
+
+	// while every lane is busy, each one is drained in proportion to its weight
+	reserved := make(map[Priority]int)
+	for i := 0; i < 14; i++ {
+		job, err := q.Reserve(context.Background())
+		if err != nil || job == nil {
+			t.Fatalf("Expected to reserve a job, got %v and error %v", job, err)
+		}
+		reserved[job.Priority]++
+	}
+	expected := map[Priority]int{PriorityHigh: 8, PriorityNormal: 4, PriorityLow: 2}
+	for p, n := range expected {
+		if reserved[p] != n {
+			t.Fatalf("Expected %d %s priority jobs reserved, got %v", n, p, reserved)
+		}
+	}
+
+	// once a lane is empty, its turns go to the others
+	for i := 0; i < 16; i++ {
+		job, _ := q.Reserve(context.Background())
+		if job == nil {
+			t.Fatalf("Expected %d more jobs to reserve, got none", 16-i)
+		}
+		reserved[job.Priority]++
+	}
+	for _, p := range lanes {
+		if reserved[p] != 10 {
+			t.Fatalf("Expected every job reserved, got %v", reserved)
+		}
+	}
+}
+
+func TestMemoryQueueUnweightedLanes(t *testing.T) {
+	q := NewMemoryQueue()
+	q.LaneWeights = LaneWeights{PriorityNormal: 1, PriorityLow: 1}
+	for p, n := range map[Priority]int{PriorityHigh: 2, PriorityNormal: 4, PriorityLow: 1} {
+		for i := 0; i < n; i++ {
+			if err := q.Push(&ProductReviewJob{ReviewID: i, Priority: p}); err != nil {
+				t.Fatalf("Unable to push review: %v", err)
+			}
+		}
+	}
+
+	// the high lane has no weight, so it waits even once the low lane is empty
+	var reserved []Priority
+	for i := 0; i < 7; i++ {
+		job, err := q.Reserve(context.Background())
+		if err != nil || job == nil {
+			t.Fatalf("Expected to reserve a job, got %v and error %v", job, err)
+		}
+		reserved = append(reserved, job.Priority)
+	}
+	for i, p := range reserved {
+		if (i < 5) == (p == PriorityHigh) {
+			t.Fatalf("Expected high priority jobs only once the other lanes are empty, got %v", reserved)
+		}
+	}
+}
+
+// blockingRecorder holds up every status it records until unblock is closed
+type blockingRecorder struct {
+	unblock chan struct{}
+}
+
+func (b *blockingRecorder) SetReviewStatus(reviewID int, status db.ReviewStatus, reason string, decisions []byte) error {
+	<-b.unblock
+	return nil
+}
+
+func TestProcessorReleasesUnfinishedJobs(t *testing.T) {
+	q := NewMemoryQueue()
+	recorder := &blockingRecorder{unblock: make(chan struct{})}
+	defer close(recorder.unblock)
+	processor := NewProcessor(q, recorder)
+	processor.DrainTimeout = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- processor.Run(ctx) }()
+
+	q.Push(&ProductReviewJob{ReviewID: 5, Review: review.ProductReview{Review: "great product"}})
+	waitFor(t, "the job to be reserved", func() bool {
+		_, reserved, _ := q.Len()
+		return reserved == 1
+	})
+
+	// the job is stuck recording its status, so it's released once the drain times out
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Expected Run to stop with %v, got %v", context.Canceled, err)
+	}
+	if ready, reserved, retrying := q.Len(); ready != 1 || reserved != 0 || retrying != 0 {
+		t.Fatalf("Expected the job back in the queue, got %d ready, %d reserved, %d retrying", ready, reserved, retrying)
+	}
+	job, _ := q.Reserve(context.Background())
+	if job == nil || job.ReviewID != 5 || job.Attempts != 0 {
+		t.Fatalf("Expected the released job with no attempts counted, got %+v", job)
+	}
+}
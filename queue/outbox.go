@@ -0,0 +1,106 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/sjbodzo/review_system/db"
+	"github.com/sjbodzo/review_system/review"
+)
+
+// OutboxStore is the outbox of saved reviews waiting to be published, implemented by db.Wrapper
+type OutboxStore interface {
+	ClaimOutbox(lease time.Duration, limit int) ([]db.OutboxRow, error)
+	MarkOutboxSent(outboxID int) error
+	MarkOutboxFailed(outboxID int, reason string) error
+}
+
+// Relay publishes the reviews saved to the outbox onto a Queue, marking each one sent
+// once it's been pushed. A review is pushed at least once, and may be pushed twice if the
+// relay dies between pushing it and marking it sent.
+type Relay struct {
+	Store OutboxStore
+	Queue Queue
+
+	// Interval is how long the relay waits between checks for unsent reviews
+	Interval time.Duration
+
+	// BatchSize is the max number of reviews published per check
+	BatchSize int
+
+	// ClaimTimeout is how long other relays keep clear of the reviews being published
+	ClaimTimeout time.Duration
+}
+
+// NewRelay returns a relay publishing from the given outbox onto the given queue
+func NewRelay(store OutboxStore, q Queue) *Relay {
+	return &Relay{
+		Store:        store,
+		Queue:        q,
+		Interval:     500 * time.Millisecond,
+		BatchSize:    100,
+		ClaimTimeout: 30 * time.Second,
+	}
+}
+
+// RelayOnce publishes a batch of unsent reviews, returning how many were pushed. It stops
+// at the first review that fails to push, since the queue is most likely unavailable.
+func (r *Relay) RelayOnce() (sent int, err error) {
+	rows, err := r.Store.ClaimOutbox(r.ClaimTimeout, r.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, row := range rows {
+		var rev review.ProductReview
+		if err := json.Unmarshal(row.Payload, &rev); err != nil {
+			// leave it in the outbox for someone to look at, rather than losing the review
+			reason := fmt.Sprintf("Unable to parse outbox payload\nError: %v", err)
+			log.Printf("Outbox row %d for review %d: %s\n", row.ProductReviewOutboxID, row.ProductReviewID, reason)
+			if err := r.Store.MarkOutboxFailed(row.ProductReviewOutboxID, reason); err != nil {
+				return sent, err
+			}
+			continue
+		}
+
+		job := &ProductReviewJob{ReviewID: row.ProductReviewID, Review: rev, Priority: Priority(row.Priority)}
+		if err := r.Queue.Push(job); err != nil {
+			// hand back this row and the rest of the batch, so they're retried promptly
+			for _, unsent := range rows[i:] {
+				r.Store.MarkOutboxFailed(unsent.ProductReviewOutboxID, err.Error())
+			}
+			return sent, err
+		}
+		if err := r.Store.MarkOutboxSent(row.ProductReviewOutboxID); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// Run publishes unsent reviews every Interval until ctx is cancelled
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// keep going while there's a backlog, rather than a batch per tick
+			for {
+				n, err := r.RelayOnce()
+				if err != nil {
+					log.Println("Outbox relay error:", err)
+				}
+				if err != nil || n < r.BatchSize || ctx.Err() != nil {
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package queue
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sjbodzo/review_system/db"
+)
+
+// fakeOutbox is an outbox kept in memory, tracking which rows were sent or failed
+type fakeOutbox struct {
+	mu     sync.Mutex
+	rows   []db.OutboxRow
+	sent   map[int]bool
+	failed map[int]string
+}
+
+func (f *fakeOutbox) ClaimOutbox(lease time.Duration, limit int) ([]db.OutboxRow, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var claimed []db.OutboxRow
+	for _, row := range f.rows {
+		if !f.sent[row.ProductReviewOutboxID] && len(claimed) < limit {
+			claimed = append(claimed, row)
+		}
+	}
+	return claimed, nil
+}
+
+func (f *fakeOutbox) MarkOutboxSent(outboxID int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent[outboxID] = true
+	return nil
+}
+
+func (f *fakeOutbox) MarkOutboxFailed(outboxID int, reason string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failed[outboxID] = reason
+	return nil
+}
+
+// failingQueue is a MemoryQueue whose pushes fail while fail is set
+type failingQueue struct {
+	*MemoryQueue
+	fail bool
+}
+
+func (q *failingQueue) Push(job *ProductReviewJob) error {
+	if q.fail {
+		return fmt.Errorf("queue is down")
+	}
+	return q.MemoryQueue.Push(job)
+}
+
+func TestRelayPublishesOutbox(t *testing.T) {
+	outbox := &fakeOutbox{
+		rows: []db.OutboxRow{
+			{ProductReviewOutboxID: 1, ProductReviewID: 10, Payload: []byte(`{"review": "great product"}`)},
+			{ProductReviewOutboxID: 2, ProductReviewID: 11, Payload: []byte(`{"review": "not bad"}`)},
+		},
+		sent:   make(map[int]bool),
+		failed: make(map[int]string),
+	}
+	q := &failingQueue{MemoryQueue: NewMemoryQueue(), fail: true}
+	relay := NewRelay(outbox, q)
+
+	// while the queue is down, nothing is sent and every row is handed back
+	if sent, err := relay.RelayOnce(); err == nil || sent != 0 {
+		t.Fatalf("Expected the push to fail with nothing sent, got %d sent and error %v", sent, err)
+	}
+	if len(outbox.failed) != 2 || len(outbox.sent) != 0 {
+		t.Fatalf("Expected both rows failed and none sent, got %v failed and %v sent", outbox.failed, outbox.sent)
+	}
+
+	// once it's back, the rows are pushed with their review ids and marked sent
+	q.fail = false
+	if sent, err := relay.RelayOnce(); err != nil || sent != 2 {
+		t.Fatalf("Expected 2 rows sent, got %d sent and error %v", sent, err)
+	}
+	if ready, _, _ := q.Len(); ready != 2 {
+		t.Fatalf("Expected 2 jobs queued, got %d", ready)
+	}
+	if sent, err := relay.RelayOnce(); err != nil || sent != 0 {
+		t.Fatalf("Expected sent rows not to be pushed again, got %d sent and error %v", sent, err)
+	}
+}
@@ -1,32 +1,98 @@
 package queue
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
-	"github.com/sjbodzo/review_system/review"
 )
 
-// maxAttempts is the max number of times to try processing a product review job
-// before discarding it and denying the client approval
-var maxAttempts = 1
-
-// ProductReviewJob represents a product review that needs processing
-type ProductReviewJob struct {
-	Review   review.ProductReview `json:"review"`
-	Attempts int                  `json:"attempts"`
-}
-
-// WorkerPool is our simple wrapper around the redis connection pool
+// WorkerPool is our simple wrapper around the redis connection pool, implementing
+// Queue on top of redis lists, or a redis stream in StreamMode. The lists and sets
+// hold job IDs, while the jobs themselves are kept in the JobsKey hash, so a job can
+// be found by its ID however its payload changes.
 type WorkerPool struct {
 	pool *redis.Pool
+
+	// Mode is how jobs are queued in redis: ListMode (the default) or StreamMode
+	Mode string
+
+	// JobsKey is the hash holding the payload of each queued job, by job ID
+	JobsKey string
+
+	// ReqQueue is where new or retried product review jobs wait to be reserved. It holds
+	// the normal priority lane, with the high and low lanes alongside it in ReqQueue:high
+	// and ReqQueue:low.
+	ReqQueue string
+
+	// ProcQueue is where reserved product review jobs sit while they're processed
+	ProcQueue string
+
+	// BlockTimeout is how long Reserve blocks waiting on a job before giving up.
+	// Redis only supports whole seconds here.
+	BlockTimeout time.Duration
+
+	// LeaseTimeout is how long a worker has to finish a job before the reaper
+	// considers it abandoned and schedules it for a retry
+	LeaseTimeout time.Duration
+
+	// ReapInterval is how often Maintain's reaper looks for jobs with expired leases
+	ReapInterval time.Duration
+
+	// DeadLetterQueue is where jobs that can't be processed are set aside for inspection
+	DeadLetterQueue string
+
+	// MaxAttempts is the max number of times to try processing a product review job
+	// before giving up on it and dead lettering it
+	MaxAttempts int
+
+	// RetryQueue is the sorted set holding jobs waiting out their Backoff before a retry
+	RetryQueue string
+	Backoff    Backoff
+
+	// PromoteInterval is how often Maintain's promoter moves jobs due for a retry back onto ReqQueue
+	PromoteInterval time.Duration
+
+	// LaneWeights is how often each priority lane gets first pick of the workers
+	LaneWeights LaneWeights
+	scheduler   laneScheduler
+
+	// Stream is the redis stream jobs are queued in, in StreamMode, with the high and low
+	// priority lanes in Stream:high and Stream:low. It's read by the consumers of Group,
+	// each of which must have a unique Consumer name; entries a consumer doesn't ack
+	// within LeaseTimeout are claimed by the reaper of another.
+	Stream   string
+	Group    string
+	Consumer string
 }
 
 // NewWorkerPool returns a worker pool for communicating with redis
 func NewWorkerPool(endpoint string, port int) *WorkerPool {
 	return &WorkerPool{
-		pool: newRedisPool(endpoint, port),
+		pool:         newRedisPool(endpoint, port),
+		Mode:         ListMode,
+		JobsKey:      "jobs",
+		ReqQueue:     "req_queue",
+		ProcQueue:    "proc_queue",
+		BlockTimeout: 1 * time.Second,
+		LeaseTimeout: 30 * time.Second,
+		ReapInterval: 10 * time.Second,
+
+		DeadLetterQueue: "dead_queue",
+
+		MaxAttempts:     3,
+		RetryQueue:      "retry_queue",
+		Backoff:         DefaultBackoff(),
+		PromoteInterval: 1 * time.Second,
+		LaneWeights:     DefaultLaneWeights(),
+
+		Stream:   "review_stream",
+		Group:    "approverd",
+		Consumer: DefaultConsumer(),
 	}
 }
 
@@ -37,99 +103,384 @@ func newRedisPool(endpoint string, port int) *redis.Pool {
 		MaxIdle:   50,
 		MaxActive: 5000,
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", address)
-			if err != nil {
-				panic(err.Error())
-			}
-			return c, err
+			return redis.Dial("tcp", address)
 		},
 	}
 }
 
-// PushReview pushes the given product review to the given list
-func (w *WorkerPool) PushReview(r review.ProductReview, listName string, attempts int) (queueLength int64, err error) {
-	job := ProductReviewJob{
-		Review:   r,
-		Attempts: attempts,
+// laneKey names the key holding the given priority lane of a request queue or stream
+func laneKey(queue string, p Priority) string {
+	if p.lane() == PriorityNormal {
+		return queue
 	}
-	msg, err := json.Marshal(&job)
+	return queue + ":" + p.String()
+}
+
+// laneKeys lists the high, normal and low priority lanes of a request queue or stream,
+// in that order, as the last KEYS of the scripts that use laneLua
+func laneKeys(queue string) []interface{} {
+	return []interface{}{laneKey(queue, PriorityHigh), laneKey(queue, PriorityNormal), laneKey(queue, PriorityLow)}
+}
+
+// signalKey names the list a token is pushed onto whenever a job is queued on a request
+// queue or stream, so idle workers can block on it rather than on every lane. It holds
+// at most one token.
+func signalKey(queue string) string {
+	return queue + ":signal"
+}
+
+// laneLua defines lane(payload), returning the lane a job payload belongs in, for
+// scripts whose last three KEYS are the high, normal and low priority lanes
+const laneLua = `
+local function lane(payload)
+	local ok, job = pcall(cjson.decode, payload or '')
+	if ok and type(job) == 'table' and type(job.priority) == 'number' then
+		if job.priority > 0 then
+			return KEYS[#KEYS - 2]
+		elseif job.priority < 0 then
+			return KEYS[#KEYS]
+		end
+	end
+	return KEYS[#KEYS - 1]
+end
+`
+
+// reserveScript moves the next job from the first lane with one onto the processing
+// queue, leasing it until the given deadline under the given lease token. If there are
+// more jobs waiting, the signal is passed on so another idle worker wakes up for them.
+//
+// KEYS: processing queue, leases set, lease tokens hash, signal, then the lanes in the
+// order to look through them. ARGV: lease deadline, lease token.
+var reserveScript = redis.NewScript(-1, `
+for i = 5, #KEYS do
+	local id = redis.call('RPOPLPUSH', KEYS[i], KEYS[1])
+	if id then
+		redis.call('ZADD', KEYS[2], ARGV[1], id)
+		redis.call('HSET', KEYS[3], id, ARGV[2])
+		for j = 5, #KEYS do
+			if redis.call('LLEN', KEYS[j]) > 0 then
+				redis.call('LPUSH', KEYS[4], 1)
+				redis.call('LTRIM', KEYS[4], 0, 0)
+				break
+			end
+		end
+		return id
+	end
+end
+return false
+`)
+
+// waitForJob calls pop to take the next job, and if there was none, waits for up to
+// BlockTimeout for a token on the signal list before calling it once more
+func (w *WorkerPool) waitForJob(c redis.Conn, signal string, pop func() (found bool, err error)) error {
+	found, err := pop()
+	if err != nil || found {
+		return err
+	}
+
+	timeout := int(w.BlockTimeout / time.Second)
+	if timeout < 1 {
+		timeout = 1
+	}
+	reply, err := c.Do("BRPOP", signal, timeout)
 	if err != nil {
-		return -1, err
+		return fmt.Errorf("Unable to wait for a job\nError: %v", err)
+	} else if reply == nil {
+		return nil
+	}
+	_, err = pop()
+	return err
+}
+
+// Push stores the given product review job and pushes its ID onto its priority lane of
+// ReqQueue, or adds it to its lane of the Stream in StreamMode
+func (w *WorkerPool) Push(job *ProductReviewJob) error {
+	if err := job.stamp(); err != nil {
+		return err
+	}
+	msg, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal review job\nError: %v", err)
 	}
 
 	c := w.pool.Get()
 	defer c.Close()
-	n, err := c.Do("LPUSH", listName, string(msg))
-	return n.(int64), err
+	if w.Mode == StreamMode {
+		return w.pushEntry(c, job, msg)
+	}
+	c.Send("MULTI")
+	c.Send("HSET", w.JobsKey, job.ID, msg)
+	c.Send("LPUSH", laneKey(w.ReqQueue, job.Priority), job.ID)
+	c.Send("LPUSH", signalKey(w.ReqQueue), 1)
+	c.Send("LTRIM", signalKey(w.ReqQueue), 0, 0)
+	if _, err := c.Do("EXEC"); err != nil {
+		return fmt.Errorf("Unable to push job onto queue\nError: %v", err)
+	}
+	return nil
 }
 
-// ProcessNextReview attempts to process the next product review in the queue,
-// incrementing the attempts counter on the job in the process. While the
-// job is being processed, it sits in the toQueue (processing) queue.
+// Reserve moves the next product review job from ReqQueue to ProcQueue, where it sits
+// under a lease while it's processed; if the lease expires first, the reaper schedules
+// the job for a retry. The job is taken from the first priority lane with one, looking
+// through the lanes in an order weighted by LaneWeights. Reserve waits for up to
+// BlockTimeout for a job to arrive, returning a nil job if none did. In StreamMode the
+// next new entry in the Stream is read for Consumer instead, and stays pending for it
+// until it's handled.
 //
-// If the job fails and the attempts counter is below the threshold,
-// the job is committed back to the fromQueue (request) queue.
-//
-// If the job fails and the attempts counter exceeds the threshold,
-// the job is discarded.
-func (w *WorkerPool) ProcessNextReview(fromQueue string, toQueue string) (err error) {
+// Jobs that can't be parsed are dead lettered straight away.
+func (w *WorkerPool) Reserve(ctx context.Context) (*ProductReviewJob, error) {
 	c := w.pool.Get()
 	defer c.Close()
-	msg, err := c.Do("RPOPLPUSH", fromQueue, toQueue)
+	if w.Mode == StreamMode {
+		return w.reserveEntry(c)
+	}
+
+	token, err := newLeaseToken()
 	if err != nil {
-		return err
-	} else if msg == nil {
-		return
+		return nil, err
+	}
+	var id string
+	err = w.waitForJob(c, signalKey(w.ReqQueue), func() (found bool, err error) {
+		keys := []interface{}{w.ProcQueue, leasesKey(w.ProcQueue), tokensKey(w.ProcQueue), signalKey(w.ReqQueue)}
+		for _, p := range w.scheduler.order(w.LaneWeights) {
+			keys = append(keys, laneKey(w.ReqQueue, p))
+		}
+		args := append([]interface{}{len(keys)}, keys...)
+		args = append(args, w.leaseDeadline(time.Now()), token)
+		id, err = redis.String(reserveScript.Do(c, args...))
+		if err == redis.ErrNil {
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("Unable to reserve job\nError: %v", err)
+		}
+		return true, nil
+	})
+	if err != nil || id == "" {
+		return nil, err
+	}
+
+	payload, err := redis.Bytes(c.Do("HGET", w.JobsKey, id))
+	if err == redis.ErrNil {
+		// the job was removed while it waited, so there's nothing left to process
+		return nil, w.ack(c, w.ProcQueue, id, token)
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to read job %s\nError: %v", id, err)
 	}
 
 	var job ProductReviewJob
-	err = json.Unmarshal(msg.([]byte), &job)
+	err = json.Unmarshal(payload, &job)
 	if err != nil {
-		return err
+		reason := fmt.Sprintf("Unable to parse job\nError: %v", err)
+		if dlErr := w.deadLetter(c, w.ProcQueue, id, token, payload, reason); dlErr != nil {
+			return nil, dlErr
+		}
+		return nil, errors.New(reason)
 	}
+	job.ID = id
+	job.leaseToken = token
+	return &job, nil
+}
 
-	fmt.Println("job popped:", job)
-	reviewer := review.DefaultLanguageReviewer()
-	approved := job.Review.ApproveReview(reviewer)
-	notifier := review.DefaultApprovalStatusNotifier()
-	if approved {
-		job.Review.NotifyClient("We hope to see you again soon!", true, notifier)
-		err = w.RemoveReview(&job, toQueue)
-		if err != nil {
-			return err
-		}
-	} else if job.Attempts+1 >= maxAttempts {
-		job.Review.NotifyClient("Please revise and resubmit your review!", true, notifier)
-		err = w.RemoveReview(&job, toQueue)
-		if err != nil {
+// Ack removes a processed job, and its lease, from ProcQueue, unless its lease ran out and
+// it's been reserved again since
+func (w *WorkerPool) Ack(job *ProductReviewJob) error {
+	c := w.pool.Get()
+	defer c.Close()
+	if w.Mode == StreamMode {
+		return w.ackEntry(c, job)
+	}
+	return w.ack(c, w.ProcQueue, job.ID, job.leaseToken)
+}
+
+// Nack schedules a job that failed to process for a retry after its Backoff, or dead
+// letters it once it has made MaxAttempts attempts
+func (w *WorkerPool) Nack(job *ProductReviewJob, reason string) error {
+	if job.Attempts+1 >= w.MaxAttempts {
+		return w.DeadLetter(job, fmt.Sprintf("Failed after %d attempts\nError: %v", job.Attempts+1, reason))
+	}
+
+	c := w.pool.Get()
+	defer c.Close()
+	var err error
+	if w.Mode == StreamMode {
+		_, err = w.retryEntry(c, job)
+	} else {
+		_, err = w.retry(c, w.ProcQueue, job)
+	}
+	return err
+}
+
+// DeadLetter moves a job from ProcQueue onto the DeadLetterQueue along with the reason
+func (w *WorkerPool) DeadLetter(job *ProductReviewJob, reason string) error {
+	payload, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal review job\nError: %v", err)
+	}
+
+	c := w.pool.Get()
+	defer c.Close()
+	if w.Mode == StreamMode {
+		stream, entry, err := w.entryOf(c, job)
+		if err != nil || entry == "" {
 			return err
 		}
+		return w.deadLetterEntry(c, stream, entry, job.ID, payload, reason)
+	}
+	return w.deadLetter(c, w.ProcQueue, job.ID, job.leaseToken, payload, reason)
+}
+
+// releaseScript moves a leased job from the processing queue back to the front of its
+// priority lane, dropping its lease, returning whether it was still reserved under the
+// given lease token.
+//
+// KEYS: processing queue, leases set, jobs hash, lease tokens hash, signal, then the high,
+// normal and low priority lanes. ARGV: job ID, lease token.
+var releaseScript = redis.NewScript(8, laneLua+leasedLua+`
+if not leased(KEYS[4], ARGV[1], ARGV[2]) then
+	return 0
+end
+local n = redis.call('LREM', KEYS[1], 0, ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[4], ARGV[1])
+if n > 0 then
+	redis.call('RPUSH', lane(redis.call('HGET', KEYS[3], ARGV[1])), ARGV[1])
+	redis.call('LPUSH', KEYS[5], 1)
+	redis.call('LTRIM', KEYS[5], 0, 0)
+end
+return n
+`)
+
+// Release moves a reserved job back to the front of its lane of ReqQueue, without
+// counting an attempt. In StreamMode the job is added to the end of its lane of the
+// Stream instead, since entries can't be put back in front.
+func (w *WorkerPool) Release(job *ProductReviewJob) error {
+	c := w.pool.Get()
+	defer c.Close()
+	var err error
+	if w.Mode == StreamMode {
+		_, err = w.releaseEntry(c, job)
 	} else {
-		job.Attempts++
-		_, err := c.Do("RPOPLPUSH", toQueue, fromQueue)
-		if err != nil {
-			return fmt.Errorf("Unable to re-queue job for review\nError: %v", err)
-		}
+		keys := append([]interface{}{w.ProcQueue, leasesKey(w.ProcQueue), w.JobsKey, tokensKey(w.ProcQueue),
+			signalKey(w.ReqQueue)}, laneKeys(w.ReqQueue)...)
+		_, err = releaseScript.Do(c, append(keys, job.ID, job.leaseToken)...)
 	}
+	if err != nil {
+		return fmt.Errorf("Unable to release job %s\nError: %v", job.ID, err)
+	}
+	return nil
+}
 
-	return
+// Close closes the pool's connections to redis
+func (w *WorkerPool) Close() error {
+	return w.pool.Close()
 }
 
-// RemoveReview attempts to remove a review job, without queueing it anywhere else
-func (w *WorkerPool) RemoveReview(job *ProductReviewJob, fromQueue string) (err error) {
-	b, err := json.Marshal(job)
-	if err != nil {
-		return fmt.Errorf("Unable to marshal review job\nError: %v", err)
+// Maintain runs the reaper and the promoter until ctx is cancelled
+func (w *WorkerPool) Maintain(ctx context.Context) {
+	reap := func() (int, error) { return w.Reap(w.ProcQueue) }
+	promote := func() (int, error) { return w.Promote(w.ReqQueue) }
+	dest := w.ReqQueue
+	if w.Mode == StreamMode {
+		reap, promote, dest = w.ReapStream, w.PromoteToStream, w.Stream
 	}
 
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		w.runReaper(ctx, reap)
+	}()
+	go func() {
+		defer wg.Done()
+		w.runPromoter(ctx, promote, dest)
+	}()
+	wg.Wait()
+}
+
+// removeScript removes a job from wherever it's queued, returning whether it was there.
+//
+// KEYS: processing queue, leases set, retry queue, jobs hash, lease tokens hash, then the
+// high, normal and low priority lanes. ARGV: job ID.
+var removeScript = redis.NewScript(8, `
+local n = redis.call('HDEL', KEYS[4], ARGV[1])
+redis.call('LREM', KEYS[1], 0, ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('HDEL', KEYS[5], ARGV[1])
+for i = 6, 8 do
+	redis.call('LREM', KEYS[i], 0, ARGV[1])
+end
+return n
+`)
+
+// requeueScript moves a job from wherever it's queued to the back of its priority lane,
+// returning whether there was such a job.
+//
+// KEYS: processing queue, leases set, retry queue, jobs hash, signal, lease tokens hash,
+// then the high, normal and low priority lanes. ARGV: job ID.
+var requeueScript = redis.NewScript(9, laneLua+`
+local payload = redis.call('HGET', KEYS[4], ARGV[1])
+if not payload then
+	return 0
+end
+redis.call('LREM', KEYS[1], 0, ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('HDEL', KEYS[6], ARGV[1])
+for i = 7, 9 do
+	redis.call('LREM', KEYS[i], 0, ARGV[1])
+end
+redis.call('LPUSH', lane(payload), ARGV[1])
+redis.call('LPUSH', KEYS[5], 1)
+redis.call('LTRIM', KEYS[5], 0, 0)
+return 1
+`)
+
+// RemoveJob removes the job with the given ID, whether it's waiting, being processed or
+// waiting on a retry, without queueing it anywhere else. Removing a job that's already
+// gone does nothing, and returns removed as false.
+func (w *WorkerPool) RemoveJob(id string) (removed bool, err error) {
 	c := w.pool.Get()
 	defer c.Close()
-	n, err := c.Do("LREM", fromQueue, 1, string(b))
+	var n int
+	if w.Mode == StreamMode {
+		if removed, err = w.removeEntry(c, id); removed {
+			n = 1
+		}
+	} else {
+		keys := append([]interface{}{w.ProcQueue, leasesKey(w.ProcQueue), w.RetryQueue, w.JobsKey,
+			tokensKey(w.ProcQueue)}, laneKeys(w.ReqQueue)...)
+		n, err = redis.Int(removeScript.Do(c, append(keys, id)...))
+	}
 	if err != nil {
-		return fmt.Errorf("Unable to remove job from queue\nError: %v", err)
-	} else if n.(int64) != 1 {
-		return fmt.Errorf("Expected to remove %d jobs from queue, but removed %d instead", 1, n)
+		return false, fmt.Errorf("Unable to remove job %s\nError: %v", id, err)
 	}
+	return n > 0, nil
+}
 
+// RequeueJob moves the job with the given ID back onto its lane of ReqQueue (or of the
+// Stream, in StreamMode) to be processed again, whether it's being processed or waiting
+// on a retry. A job that's already waiting is moved to the back of the line, so
+// requeueing twice is the same as requeueing once.
+func (w *WorkerPool) RequeueJob(id string) error {
+	c := w.pool.Get()
+	defer c.Close()
+	var n int
+	var err error
+	if w.Mode == StreamMode {
+		var requeued bool
+		if requeued, err = w.requeueEntry(c, id); requeued {
+			n = 1
+		}
+	} else {
+		keys := append([]interface{}{w.ProcQueue, leasesKey(w.ProcQueue), w.RetryQueue, w.JobsKey,
+			signalKey(w.ReqQueue), tokensKey(w.ProcQueue)}, laneKeys(w.ReqQueue)...)
+		n, err = redis.Int(requeueScript.Do(c, append(keys, id)...))
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to requeue job %s\nError: %v", id, err)
+	} else if n == 0 {
+		return fmt.Errorf("No job with ID %s", id)
+	}
 	return nil
 }
@@ -0,0 +1,305 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/sjbodzo/review_system/db"
+)
+
+// reapBatchSize caps how many expired jobs a single reap handles at once
+const reapBatchSize = 100
+
+// JobStore is the table of jobs behind a PostgresQueue, implemented by db.Wrapper
+type JobStore interface {
+	EnqueueJob(payload []byte, priority int) (id int, err error)
+	ReserveJob(lease time.Duration, priority int) (*db.JobRow, error)
+	DeleteJob(jobID int, token string) error
+	RetryJob(jobID int, token string, delay time.Duration, reason string) error
+	DeadLetterJob(jobID int, token string, reason string) error
+	ReleaseJob(jobID int, token string) error
+	ExpiredJobs(limit int) ([]db.JobRow, error)
+
+	ListDeadJobs(offset int, limit int) ([]db.JobRow, error)
+	GetDeadJob(jobID int) (*db.JobRow, error)
+	ReplayDeadJob(jobID int) error
+	PurgeDeadJob(jobID int) error
+	PurgeDeadJobs() (purged int, err error)
+}
+
+// DeadJob is a dead letter in a PostgresQueue, identified by the job's row in the job table
+type DeadJob struct {
+	RowID int `json:"rowID"`
+	DeadLetter
+}
+
+// PostgresQueue is a Queue kept in a table of the AdventureWorks database, so the review
+// pipeline can run without redis. Workers claim jobs with FOR UPDATE SKIP LOCKED, and
+// attempts, retries and dead letters behave as they do in the redis WorkerPool.
+type PostgresQueue struct {
+	store JobStore
+
+	// PollInterval is how long Reserve waits between checks for a ready job
+	PollInterval time.Duration
+
+	// BlockTimeout is how long Reserve polls for a job before giving up
+	BlockTimeout time.Duration
+
+	// LeaseTimeout is how long a worker has to finish a job before the reaper
+	// considers it abandoned and schedules it for a retry
+	LeaseTimeout time.Duration
+
+	// ReapInterval is how often Maintain's reaper looks for jobs with expired leases
+	ReapInterval time.Duration
+
+	// MaxAttempts is the max number of times to try processing a product review job
+	// before giving up on it and dead lettering it
+	MaxAttempts int
+
+	// Backoff is how long failed jobs wait before they're retried
+	Backoff Backoff
+
+	// LaneWeights is how often each priority lane gets first pick of the workers
+	LaneWeights LaneWeights
+	scheduler   laneScheduler
+}
+
+// NewPostgresQueue returns a queue backed by the job table in the given store
+func NewPostgresQueue(store JobStore) *PostgresQueue {
+	return &PostgresQueue{
+		store:        store,
+		PollInterval: 500 * time.Millisecond,
+		BlockTimeout: 1 * time.Second,
+		LeaseTimeout: 30 * time.Second,
+		ReapInterval: 10 * time.Second,
+		MaxAttempts:  3,
+		Backoff:      DefaultBackoff(),
+		LaneWeights:  DefaultLaneWeights(),
+	}
+}
+
+// Push inserts the given product review job into the job table
+func (q *PostgresQueue) Push(job *ProductReviewJob) error {
+	if err := job.stamp(); err != nil {
+		return err
+	}
+	msg, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal review job\nError: %v", err)
+	}
+	_, err = q.store.EnqueueJob(msg, int(job.Priority.lane()))
+	return err
+}
+
+// Reserve claims the oldest job that's ready to run in the lane whose turn it is, leasing
+// it for LeaseTimeout. It polls every PollInterval for up to BlockTimeout, returning a nil
+// job if none was ready.
+//
+// Jobs that can't be parsed are dead lettered straight away.
+func (q *PostgresQueue) Reserve(ctx context.Context) (*ProductReviewJob, error) {
+	deadline := time.Now().Add(q.BlockTimeout)
+	for {
+		for _, p := range q.scheduler.order(q.LaneWeights) {
+			row, err := q.store.ReserveJob(q.LeaseTimeout, int(p))
+			if err == nil {
+				return q.toJob(row)
+			} else if err != db.ErrNotFound {
+				return nil, err
+			}
+		}
+
+		wait := q.PollInterval
+		if left := time.Until(deadline); left <= 0 {
+			return nil, nil
+		} else if left < wait {
+			wait = left
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// toJob parses a reserved row into its job, dead lettering rows that can't be parsed
+func (q *PostgresQueue) toJob(row *db.JobRow) (*ProductReviewJob, error) {
+	var job ProductReviewJob
+	if err := json.Unmarshal(row.Payload, &job); err != nil {
+		reason := fmt.Sprintf("Unable to parse job\nError: %v", err)
+		if dlErr := q.store.DeadLetterJob(row.ProductReviewJobID, leaseToken(row), reason); dlErr != nil {
+			return nil, dlErr
+		}
+		return nil, errors.New(reason)
+	}
+	job.Attempts = row.Attempts
+	job.Priority = Priority(row.Priority)
+	job.rowID = row.ProductReviewJobID
+	job.leaseToken = leaseToken(row)
+	return &job, nil
+}
+
+// leaseToken returns the token a row is reserved under
+func leaseToken(row *db.JobRow) string {
+	if row.LeaseToken == nil {
+		return ""
+	}
+	return *row.LeaseToken
+}
+
+// Ack deletes a processed job from the job table, unless its lease ran out and it's been
+// reserved again since
+func (q *PostgresQueue) Ack(job *ProductReviewJob) error {
+	return ignoreReleased(q.store.DeleteJob(job.rowID, job.leaseToken))
+}
+
+// Nack schedules a job that failed to process for a retry after its Backoff, or dead
+// letters it once it has made MaxAttempts attempts
+func (q *PostgresQueue) Nack(job *ProductReviewJob, reason string) error {
+	if job.Attempts+1 >= q.MaxAttempts {
+		return q.DeadLetter(job, fmt.Sprintf("Failed after %d attempts\nError: %v", job.Attempts+1, reason))
+	}
+	return ignoreReleased(q.store.RetryJob(job.rowID, job.leaseToken, q.Backoff.Delay(job.Attempts+1), reason))
+}
+
+// DeadLetter sets a reserved job aside for good, along with the reason
+func (q *PostgresQueue) DeadLetter(job *ProductReviewJob, reason string) error {
+	return ignoreReleased(q.store.DeadLetterJob(job.rowID, job.leaseToken, reason))
+}
+
+// Release hands a reserved job back to be reserved again, in its original place in line
+func (q *PostgresQueue) Release(job *ProductReviewJob) error {
+	return ignoreReleased(q.store.ReleaseJob(job.rowID, job.leaseToken))
+}
+
+// ignoreReleased drops the error from acting on a job that's no longer reserved under the
+// same lease, since it's already been handled, either by an earlier call or by the reaper,
+// and may be in another worker's hands by now
+func ignoreReleased(err error) error {
+	if err == db.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// Reap schedules the jobs whose lease has expired for a retry, or dead letters the ones
+// that have run out of attempts
+func (q *PostgresQueue) Reap() (reaped int, err error) {
+	expired, err := q.store.ExpiredJobs(reapBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range expired {
+		row := &expired[i]
+		if row.Attempts+1 >= q.MaxAttempts {
+			err = q.store.DeadLetterJob(row.ProductReviewJobID, leaseToken(row), fmt.Sprintf("Lease expired after %d attempts", row.Attempts+1))
+		} else {
+			err = q.store.RetryJob(row.ProductReviewJobID, leaseToken(row), q.Backoff.Delay(row.Attempts+1), "Lease expired")
+		}
+		if err == db.ErrNotFound {
+			continue // acked or reaped elsewhere in the meantime
+		} else if err != nil {
+			return reaped, err
+		}
+		reaped++
+	}
+	return reaped, nil
+}
+
+// DeadJobs lists up to limit dead lettered jobs, most recently failed first, skipping the
+// first offset of them
+func (q *PostgresQueue) DeadJobs(offset int, limit int) ([]DeadJob, error) {
+	rows, err := q.store.ListDeadJobs(offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]DeadJob, len(rows))
+	for i := range rows {
+		jobs[i] = toDeadJob(&rows[i])
+	}
+	return jobs, nil
+}
+
+// InspectDeadJob returns the dead lettered job in the given row
+func (q *PostgresQueue) InspectDeadJob(rowID int) (*DeadJob, error) {
+	row, err := q.store.GetDeadJob(rowID)
+	if err == db.ErrNotFound {
+		return nil, fmt.Errorf("No dead job in row %d", rowID)
+	} else if err != nil {
+		return nil, err
+	}
+	job := toDeadJob(row)
+	return &job, nil
+}
+
+// toDeadJob reads a dead lettered row into its dead letter
+func toDeadJob(row *db.JobRow) DeadJob {
+	dead := DeadJob{RowID: row.ProductReviewJobID, DeadLetter: DeadLetter{Payload: string(row.Payload)}}
+	if row.LastError != nil {
+		dead.Reason = *row.LastError
+	}
+	if row.FailedDate != nil {
+		dead.FailedAt = row.FailedDate.UTC()
+	}
+	var job ProductReviewJob
+	if err := json.Unmarshal(row.Payload, &job); err == nil {
+		job.Attempts = row.Attempts
+		job.Priority = Priority(row.Priority)
+		dead.Job = &job
+	}
+	return dead
+}
+
+// ReplayDeadJob hands the dead lettered job in the given row back to be reserved straight
+// away, in its original priority lane, with its attempts reset
+func (q *PostgresQueue) ReplayDeadJob(rowID int) error {
+	if err := q.store.ReplayDeadJob(rowID); err == db.ErrNotFound {
+		return fmt.Errorf("No dead job in row %d", rowID)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// PurgeDeadJob discards the dead lettered job in the given row for good
+func (q *PostgresQueue) PurgeDeadJob(rowID int) error {
+	if err := q.store.PurgeDeadJob(rowID); err == db.ErrNotFound {
+		return fmt.Errorf("No dead job in row %d", rowID)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// PurgeDeadJobs discards every dead lettered job for good, returning how many there were
+func (q *PostgresQueue) PurgeDeadJobs() (purged int, err error) {
+	return q.store.PurgeDeadJobs()
+}
+
+// Maintain reaps jobs with expired leases every ReapInterval until ctx is cancelled.
+// A zero ReapInterval disables the reaper.
+func (q *PostgresQueue) Maintain(ctx context.Context) {
+	if q.ReapInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(q.ReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := q.Reap()
+			if err != nil {
+				log.Println("Reaper error:", err)
+			} else if n > 0 {
+				log.Printf("Reaper handled %d jobs with expired leases\n", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sjbodzo/review_system/db"
+)
+
+// fakeJobStore keeps the job table in memory, with the same lease token checks as db.Wrapper
+type fakeJobStore struct {
+	mu     sync.Mutex
+	rows   map[int]*db.JobRow
+	nextID int
+	tokens int
+}
+
+func newFakeJobStore() *fakeJobStore {
+	return &fakeJobStore{rows: make(map[int]*db.JobRow)}
+}
+
+func (f *fakeJobStore) EnqueueJob(payload []byte, priority int) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	f.rows[f.nextID] = &db.JobRow{ProductReviewJobID: f.nextID, Payload: payload, Priority: priority,
+		State: "ready", RunAfter: time.Now(), CreatedDate: time.Now()}
+	return f.nextID, nil
+}
+
+func (f *fakeJobStore) ReserveJob(lease time.Duration, priority int) (*db.JobRow, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id := 1; id <= f.nextID; id++ {
+		row, ok := f.rows[id]
+		if !ok || row.State != "ready" || row.Priority != priority || row.RunAfter.After(time.Now()) {
+			continue
+		}
+		f.tokens++
+		token, until := fmt.Sprintf("token%d", f.tokens), time.Now().Add(lease)
+		row.State, row.LeaseToken, row.LeasedUntil = "reserved", &token, &until
+		reserved := *row
+		return &reserved, nil
+	}
+	return nil, db.ErrNotFound
+}
+
+// reserved returns the row reserved under the token, if it still is
+func (f *fakeJobStore) reserved(jobID int, token string) (*db.JobRow, error) {
+	row, ok := f.rows[jobID]
+	if !ok || row.State != "reserved" || row.LeaseToken == nil || *row.LeaseToken != token {
+		return nil, db.ErrNotFound
+	}
+	return row, nil
+}
+
+func (f *fakeJobStore) DeleteJob(jobID int, token string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.reserved(jobID, token); err != nil {
+		return err
+	}
+	delete(f.rows, jobID)
+	return nil
+}
+
+func (f *fakeJobStore) RetryJob(jobID int, token string, delay time.Duration, reason string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	row, err := f.reserved(jobID, token)
+	if err != nil {
+		return err
+	}
+	row.State, row.Attempts, row.RunAfter = "ready", row.Attempts+1, time.Now().Add(delay)
+	row.LeaseToken, row.LeasedUntil, row.LastError = nil, nil, &reason
+	return nil
+}
+
+func (f *fakeJobStore) DeadLetterJob(jobID int, token string, reason string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	row, err := f.reserved(jobID, token)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	row.State, row.LeaseToken, row.LeasedUntil, row.LastError, row.FailedDate = "dead", nil, nil, &reason, &now
+	return nil
+}
+
+func (f *fakeJobStore) ReleaseJob(jobID int, token string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	row, err := f.reserved(jobID, token)
+	if err != nil {
+		return err
+	}
+	row.State, row.LeaseToken, row.LeasedUntil = "ready", nil, nil
+	return nil
+}
+
+func (f *fakeJobStore) ExpiredJobs(limit int) ([]db.JobRow, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var expired []db.JobRow
+	for id := 1; id <= f.nextID && len(expired) < limit; id++ {
+		if row, ok := f.rows[id]; ok && row.State == "reserved" && row.LeasedUntil.Before(time.Now()) {
+			expired = append(expired, *row)
+		}
+	}
+	return expired, nil
+}
+
+func (f *fakeJobStore) ListDeadJobs(offset int, limit int) ([]db.JobRow, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var dead []db.JobRow
+	for id := f.nextID; id >= 1 && len(dead) < limit; id-- {
+		if row, ok := f.rows[id]; ok && row.State == "dead" {
+			if offset > 0 {
+				offset--
+				continue
+			}
+			dead = append(dead, *row)
+		}
+	}
+	return dead, nil
+}
+
+func (f *fakeJobStore) GetDeadJob(jobID int) (*db.JobRow, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	row, ok := f.rows[jobID]
+	if !ok || row.State != "dead" {
+		return nil, db.ErrNotFound
+	}
+	dead := *row
+	return &dead, nil
+}
+
+func (f *fakeJobStore) ReplayDeadJob(jobID int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	row, ok := f.rows[jobID]
+	if !ok || row.State != "dead" {
+		return db.ErrNotFound
+	}
+	row.State, row.Attempts, row.RunAfter, row.LastError, row.FailedDate = "ready", 0, time.Now(), nil, nil
+	return nil
+}
+
+func (f *fakeJobStore) PurgeDeadJob(jobID int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	row, ok := f.rows[jobID]
+	if !ok || row.State != "dead" {
+		return db.ErrNotFound
+	}
+	delete(f.rows, jobID)
+	return nil
+}
+
+func (f *fakeJobStore) PurgeDeadJobs() (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	purged := 0
+	for id, row := range f.rows {
+		if row.State == "dead" {
+			delete(f.rows, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// state returns the state of the job's row, or "gone" if it's been deleted
+func (f *fakeJobStore) state(jobID int) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if row, ok := f.rows[jobID]; ok {
+		return row.State
+	}
+	return "gone"
+}
+
+func TestPostgresQueueIgnoresStaleLeases(t *testing.T) {
+	store := newFakeJobStore()
+	q := NewPostgresQueue(store)
+	q.LeaseTimeout = time.Millisecond
+	q.Backoff = Backoff{}
+	q.PollInterval = time.Millisecond
+
+	if err := q.Push(&ProductReviewJob{ReviewID: 1}); err != nil {
+		t.Fatalf("Unable to push job: %v", err)
+	}
+	first, err := q.Reserve(context.Background())
+	if err != nil || first == nil {
+		t.Fatalf("Unable to reserve job: %v", err)
+	}
+
+	// the first worker's lease runs out, and the job is retried and reserved by a second
+	time.Sleep(5 * time.Millisecond)
+	if n, err := q.Reap(); err != nil || n != 1 {
+		t.Fatalf("Expected the reaper to retry 1 job, got %d: %v", n, err)
+	}
+	q.LeaseTimeout = time.Minute
+	second, err := q.Reserve(context.Background())
+	if err != nil || second == nil || second.rowID != first.rowID {
+		t.Fatalf("Unable to reserve the retried job: %v", err)
+	}
+
+	// the first worker finishing late mustn't touch the second worker's reservation
+	for name, late := range map[string]func(job *ProductReviewJob) error{
+		"Ack":        q.Ack,
+		"Nack":       func(job *ProductReviewJob) error { return q.Nack(job, "late") },
+		"DeadLetter": func(job *ProductReviewJob) error { return q.DeadLetter(job, "late") },
+		"Release":    q.Release,
+	} {
+		if err := late(first); err != nil {
+			t.Fatalf("Expected a late %s to do nothing, got %v", name, err)
+		}
+		if state := store.state(first.rowID); state != "reserved" {
+			t.Fatalf("Expected a late %s to leave the job reserved, got %s", name, state)
+		}
+	}
+
+	if err := q.Ack(second); err != nil {
+		t.Fatalf("Unable to ack job: %v", err)
+	}
+	if state := store.state(second.rowID); state != "gone" {
+		t.Fatalf("Expected the second worker's ack to delete the job, got %s", state)
+	}
+}
+
+func TestPostgresQueueDeadJobs(t *testing.T) {
+	store := newFakeJobStore()
+	q := NewPostgresQueue(store)
+	q.MaxAttempts = 1
+	q.PollInterval = time.Millisecond
+
+	for reviewID := 1; reviewID <= 3; reviewID++ {
+		if err := q.Push(&ProductReviewJob{ReviewID: reviewID}); err != nil {
+			t.Fatalf("Unable to push job: %v", err)
+		}
+		job, err := q.Reserve(context.Background())
+		if err != nil || job == nil {
+			t.Fatalf("Unable to reserve job: %v", err)
+		}
+		if err := q.Nack(job, "database is down"); err != nil {
+			t.Fatalf("Unable to nack job: %v", err)
+		}
+	}
+
+	dead, err := q.DeadJobs(0, 10)
+	if err != nil || len(dead) != 3 {
+		t.Fatalf("Expected 3 dead jobs, got %v: %v", dead, err)
+	}
+	if dead[0].Job == nil || dead[0].Job.ReviewID != 3 || dead[0].Reason == "" {
+		t.Fatalf("Expected the latest dead job first, with its reason, got %+v", dead[0])
+	}
+
+	// a replayed job is reserved again with its attempts reset
+	if err := q.ReplayDeadJob(dead[0].RowID); err != nil {
+		t.Fatalf("Unable to replay dead job: %v", err)
+	}
+	if err := q.ReplayDeadJob(dead[0].RowID); err == nil {
+		t.Fatalf("Expected replaying a job that isn't dead to fail")
+	}
+	job, err := q.Reserve(context.Background())
+	if err != nil || job == nil || job.ReviewID != 3 || job.Attempts != 0 {
+		t.Fatalf("Expected to reserve the replayed job, got %+v: %v", job, err)
+	}
+
+	if err := q.PurgeDeadJob(dead[1].RowID); err != nil {
+		t.Fatalf("Unable to purge dead job: %v", err)
+	}
+	if n, err := q.PurgeDeadJobs(); err != nil || n != 1 {
+		t.Fatalf("Expected to purge the last dead job, purged %d: %v", n, err)
+	}
+	if dead, err := q.DeadJobs(0, 10); err != nil || len(dead) != 0 {
+		t.Fatalf("Expected no dead jobs left, got %v: %v", dead, err)
+	}
+}
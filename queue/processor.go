@@ -0,0 +1,217 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/sjbodzo/review_system/db"
+	"github.com/sjbodzo/review_system/review"
+)
+
+// Processor runs product review jobs from a Queue through approval, independently of
+// which backend the queue is
+type Processor struct {
+	Queue Queue
+
+	// Recorder, if set, is where approve/deny decisions are written back to
+	Recorder StatusRecorder
+
+	// Pipeline is the chain of reviewers every review is vetted by, and the notifiers
+	// told the outcome
+	Pipeline *review.Pipeline
+
+	// Workers is how many goroutines Run uses to process reviews concurrently
+	Workers int
+
+	// ErrorBackoff is how long a worker waits after a failure before trying again
+	ErrorBackoff time.Duration
+
+	// DrainTimeout is how long Run waits, once it's stopped, for the jobs being processed
+	// to finish before releasing them back to the queue
+	DrainTimeout time.Duration
+
+	mu       sync.Mutex
+	inflight map[string]*ProductReviewJob
+}
+
+// NewProcessor returns a Processor for the queue using sensible defaults
+func NewProcessor(q Queue, recorder StatusRecorder) *Processor {
+	return &Processor{
+		Queue:        q,
+		Recorder:     recorder,
+		Pipeline:     review.DefaultPipeline(),
+		Workers:      4,
+		ErrorBackoff: 1 * time.Second,
+		DrainTimeout: 10 * time.Second,
+		inflight:     make(map[string]*ProductReviewJob),
+	}
+}
+
+// Run processes product reviews as soon as they arrive, using Workers goroutines that
+// each block on the queue, until ctx is cancelled. If the queue is a Maintainer, its
+// upkeep runs alongside them. Once ctx is cancelled no more jobs are reserved, and Run
+// waits for up to DrainTimeout for the jobs already being processed to finish,
+// releasing any that haven't back to the queue before returning.
+func (p *Processor) Run(ctx context.Context) error {
+	workers := p.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	if m, ok := p.Queue.(Maintainer); ok {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Maintain(ctx)
+		}()
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+
+				err := p.ProcessNext(ctx)
+				if err != nil {
+					log.Printf("Worker %d error: %v\n", id, err)
+					// don't spin against the queue while it's failing
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(p.ErrorBackoff):
+					}
+				}
+			}
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	<-ctx.Done()
+	select {
+	case <-done:
+	case <-time.After(p.DrainTimeout):
+		p.releaseUnfinished()
+	}
+	return ctx.Err()
+}
+
+// releaseUnfinished releases the jobs still being processed back to the queue, so
+// another worker picks them up. Workers that finish one of them afterwards ack or nack
+// a job that's no longer reserved, which does nothing.
+func (p *Processor) releaseUnfinished() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, job := range p.inflight {
+		if err := p.Queue.Release(job); err != nil {
+			log.Printf("Unable to release unfinished job %s: %v\n", id, err)
+			continue
+		}
+		log.Printf("Released unfinished job %s\n", id)
+		delete(p.inflight, id)
+	}
+}
+
+// ProcessNext reserves the next product review job and processes it, returning
+// without error if no job arrived before the queue stopped waiting. A job reserved
+// just as ctx is cancelled is released straight back to the queue.
+func (p *Processor) ProcessNext(ctx context.Context) error {
+	job, err := p.Queue.Reserve(ctx)
+	if err != nil {
+		return err
+	} else if job == nil {
+		return nil
+	} else if ctx.Err() != nil {
+		return p.Queue.Release(job)
+	}
+
+	p.mu.Lock()
+	p.inflight[job.ID] = job
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.inflight, job.ID)
+		p.mu.Unlock()
+	}()
+	return p.Process(job)
+}
+
+// Process vets a reserved product review job for approval through the Pipeline, records
+// the decision and notifies the client before acking the job.
+//
+// If the decision can't be recorded, the job is nacked so the queue retries it
+// after a backoff, or dead letters it once it runs out of attempts.
+func (p *Processor) Process(job *ProductReviewJob) error {
+	log.Println("job reserved:", *job)
+	verdict := p.Pipeline.Approve(&job.Review)
+	approved := verdict.Approved
+
+	status, reason, msg := db.StatusApproved, "Review passed all reviewers", "We hope to see you again soon!"
+	switch verdict.Outcome {
+	case review.OutcomeReject:
+		status, reason, msg = db.StatusRejected, "Review was rejected by a reviewer",
+			"Please revise and resubmit your review!\n"+verdict.Explain()
+	case review.OutcomeManual:
+		status, reason = db.StatusNeedsManualReview, "Review needs a moderator to decide"
+	}
+	if verdict.Reason != "" {
+		reason = verdict.Reason
+	}
+
+	decisions, err := json.Marshal(verdict.Decisions)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal decisions for job %s\nError: %v", job.ID, err)
+	}
+	log.Printf("job %s %s: %s\n", job.ID, status, decisions)
+
+	if err := p.recordStatus(job, status, reason, decisions, verdict.VerifiedPurchase()); err != nil {
+		if nackErr := p.Queue.Nack(job, err.Error()); nackErr != nil {
+			return nackErr
+		}
+		return err
+	}
+	// reviews left to a moderator aren't settled yet, so there's nothing to tell the client
+	if verdict.Outcome != review.OutcomeManual {
+		p.Pipeline.Notify(&job.Review, approved, msg)
+	}
+	return p.Queue.Ack(job)
+}
+
+// recordStatus writes the moderation decision for the job's review through the Recorder, if any,
+// along with whether its author bought the product if a reviewer checked and the Recorder's a
+// PurchaseRecorder. Jobs queued without a review id can't be matched to a row, so they are only logged.
+func (p *Processor) recordStatus(job *ProductReviewJob, status db.ReviewStatus, reason string,
+	decisions []byte, verified *bool) error {
+	if p.Recorder == nil {
+		return nil
+	}
+	if job.ReviewID == 0 {
+		log.Printf("Unable to record status %q for review by %s: job has no review id\n",
+			status, job.Review.EmailAddress)
+		return nil
+	}
+	if purchases, ok := p.Recorder.(PurchaseRecorder); ok && verified != nil {
+		if err := purchases.SetVerifiedPurchase(job.ReviewID, *verified); err != nil {
+			return fmt.Errorf("Unable to record verified purchase for review %d\nError: %v", job.ReviewID, err)
+		}
+	}
+	if err := p.Recorder.SetReviewStatus(job.ReviewID, status, reason, decisions); err != nil {
+		return fmt.Errorf("Unable to record status %q for review %d\nError: %v", status, job.ReviewID, err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package queue
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sjbodzo/review_system/db"
+	"github.com/sjbodzo/review_system/review"
+)
+
+// ProductReviewJob represents a product review that needs processing
+type ProductReviewJob struct {
+	// ID identifies the job for as long as it's queued, across retries and dead lettering
+	ID         string               `json:"id"`
+	EnqueuedAt time.Time            `json:"enqueuedAt"`
+	ReviewID   int                  `json:"reviewid,omitempty"`
+	Review     review.ProductReview `json:"review"`
+	Attempts   int                  `json:"attempts"`
+	Priority   Priority             `json:"priority,omitempty"`
+
+	// rowID is the job's row in the postgres backend's job table
+	rowID int
+
+	// leaseToken identifies the reservation the job was reserved under, so acting on it once
+	// its lease has run out and it's been reserved again does nothing
+	leaseToken string
+
+	// entryID refers to the stream entry the job was reserved from, as "<lane stream> <entry ID>",
+	// in a WorkerPool in StreamMode
+	entryID string
+}
+
+// stamp gives a job that's about to be queued an ID and enqueue time, unless it has them already
+func (job *ProductReviewJob) stamp() error {
+	if job.ID == "" {
+		id, err := newJobID()
+		if err != nil {
+			return err
+		}
+		job.ID = id
+	}
+	if job.EnqueuedAt.IsZero() {
+		job.EnqueuedAt = time.Now().UTC()
+	}
+	return nil
+}
+
+// newJobID returns a random, unique job ID
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		return "", fmt.Errorf("Unable to generate job ID\nError: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Queue is a job queue that product reviews wait in until they're processed.
+// Every Reserve must be followed by one of Ack, Nack, DeadLetter or Release for the job.
+//
+// Ack, Nack, DeadLetter and Release find the job by its ID and the reservation it was handed
+// out under, and do nothing if it isn't reserved under it anymore (e.g. it was acked already,
+// or its lease expired and it's been retried or handed to another worker since), so they're
+// safe to repeat, and safe to call once a lease has run out.
+type Queue interface {
+	// Push queues the job up for processing, stamping it with an ID and enqueue time
+	// first unless it has them already
+	Push(job *ProductReviewJob) error
+
+	// Reserve hands out the next job for processing, blocking until one arrives.
+	// It returns a nil job, without error, if none arrived before ctx was done
+	// or the backend stopped waiting.
+	Reserve(ctx context.Context) (*ProductReviewJob, error)
+
+	// Ack marks a reserved job as done, removing it from the queue
+	Ack(job *ProductReviewJob) error
+
+	// Nack gives back a reserved job that failed to process. It's retried after a
+	// backoff if it has attempts left, or dead lettered with the reason otherwise.
+	Nack(job *ProductReviewJob, reason string) error
+
+	// DeadLetter sets a reserved job aside for good, along with the reason
+	DeadLetter(job *ProductReviewJob, reason string) error
+
+	// Release gives back a reserved job that wasn't processed, e.g. because the worker
+	// is shutting down, so it's handed out again right away without counting an attempt
+	Release(job *ProductReviewJob) error
+}
+
+// Maintainer is implemented by queues that need upkeep running in the background
+// while jobs are processed, e.g. reaping expired leases. Maintain runs until ctx is done.
+type Maintainer interface {
+	Maintain(ctx context.Context)
+}
+
+// StatusRecorder persists the moderation decision made on a product review, along with
+// the json encoded decisions of each reviewer that led to it
+type StatusRecorder interface {
+	SetReviewStatus(reviewID int, status db.ReviewStatus, reason string, decisions []byte) error
+}
+
+// PurchaseRecorder is implemented by StatusRecorders that also persist whether the author
+// of a product review bought the product, when a reviewer found out
+type PurchaseRecorder interface {
+	SetVerifiedPurchase(reviewID int, verified bool) error
+}
+
+// Backoff computes how long a failed job waits before it's retried
+type Backoff struct {
+	// BaseDelay is how long the first retry waits; each retry after it waits twice
+	// as long as the one before, up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Jitter randomizes each delay by up to this fraction of it (0 to 1),
+	// so jobs that failed together don't all retry together
+	Jitter float64
+}
+
+// DefaultBackoff provides a sensible default backoff for retrying jobs
+func DefaultBackoff() Backoff {
+	return Backoff{BaseDelay: 5 * time.Second, MaxDelay: 5 * time.Minute, Jitter: 0.2}
+}
+
+// jitterRnd is shared by every Backoff, since a rand.Rand isn't safe for concurrent use on its own
+var jitterRnd = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// Delay returns how long a job waits before its next attempt, given how many
+// attempts it has made so far
+func (b Backoff) Delay(attempts int) time.Duration {
+	delay := b.BaseDelay
+	for i := 1; i < attempts && delay < b.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > b.MaxDelay {
+		delay = b.MaxDelay
+	}
+
+	if b.Jitter > 0 {
+		jitterRnd.Lock()
+		r := jitterRnd.Float64()
+		jitterRnd.Unlock()
+		// spread the delay evenly across [1-jitter, 1+jitter] of itself
+		delay = time.Duration(float64(delay) * (1 + b.Jitter*(2*r-1)))
+	}
+	return delay
+}
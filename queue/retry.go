@@ -0,0 +1,115 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// promoteBatchSize caps how many due jobs a single promotion moves at once
+const promoteBatchSize = 100
+
+// retryScript moves a leased job from the processing queue into the retry queue, due at
+// the given time, dropping its lease and storing its updated payload. The job is only
+// scheduled if it's still reserved under the given lease token, so a job acked, or
+// reaped and handed to another worker, in the meantime isn't run twice.
+//
+// KEYS: processing queue, leases set, retry queue, jobs hash, lease tokens hash. ARGV: job
+// ID, retried payload, due time, lease token.
+var retryScript = redis.NewScript(5, leasedLua+`
+if not leased(KEYS[5], ARGV[1], ARGV[4]) then
+	return 0
+end
+local n = redis.call('LREM', KEYS[1], 0, ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[5], ARGV[1])
+if n > 0 then
+	redis.call('HSET', KEYS[4], ARGV[1], ARGV[2])
+	redis.call('ZADD', KEYS[3], ARGV[3], ARGV[1])
+end
+return n
+`)
+
+// promoteScript moves up to a batch of jobs whose retry is due onto their priority lane
+// of the request queue.
+//
+// KEYS: retry queue, jobs hash, signal, then the high, normal and low priority lanes.
+// ARGV: current time, batch size.
+var promoteScript = redis.NewScript(6, laneLua+`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, id in ipairs(due) do
+	redis.call('ZREM', KEYS[1], id)
+	redis.call('LPUSH', lane(redis.call('HGET', KEYS[2], id)), id)
+end
+if #due > 0 then
+	redis.call('LPUSH', KEYS[3], 1)
+	redis.call('LTRIM', KEYS[3], 0, 0)
+end
+return #due
+`)
+
+// retry moves the job out of the processing queue and into the retry queue with its
+// attempts counter incremented, due once its Backoff has passed
+func (w *WorkerPool) retry(c redis.Conn, procQueue string, job *ProductReviewJob) (retried bool, err error) {
+	next := *job
+	next.Attempts++
+	payload, err := json.Marshal(&next)
+	if err != nil {
+		return false, fmt.Errorf("Unable to marshal review job\nError: %v", err)
+	}
+
+	due := time.Now().Add(w.Backoff.Delay(next.Attempts)).UnixNano() / int64(time.Millisecond)
+	n, err := redis.Int(retryScript.Do(c, procQueue, leasesKey(procQueue), w.RetryQueue, w.JobsKey,
+		tokensKey(procQueue), job.ID, payload, due, job.leaseToken))
+	if err != nil {
+		return false, fmt.Errorf("Unable to schedule job for retry\nError: %v", err)
+	}
+	return n > 0, nil
+}
+
+// Promote moves the jobs in the retry queue whose backoff has passed onto their lane of
+// the request queue, returning how many were moved
+func (w *WorkerPool) Promote(reqQueue string) (promoted int, err error) {
+	c := w.pool.Get()
+	defer c.Close()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for {
+		keys := append([]interface{}{w.RetryQueue, w.JobsKey, signalKey(reqQueue)}, laneKeys(reqQueue)...)
+		n, err := redis.Int(promoteScript.Do(c, append(keys, now, promoteBatchSize)...))
+		if err != nil {
+			return promoted, fmt.Errorf("Unable to promote jobs due for retry\nError: %v", err)
+		}
+		promoted += n
+		if n < promoteBatchSize {
+			return promoted, nil
+		}
+	}
+}
+
+// runPromoter promotes jobs due for retry onto dest every PromoteInterval until ctx is
+// cancelled. A zero PromoteInterval disables the promoter.
+func (w *WorkerPool) runPromoter(ctx context.Context, promote func() (int, error), dest string) {
+	if w.PromoteInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(w.PromoteInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := promote()
+			if err != nil {
+				log.Println("Promoter error:", err)
+			} else if n > 0 {
+				log.Printf("Promoter moved %d jobs due for retry back to %s\n", n, dest)
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/sjbodzo/review_system/db"
+	"github.com/sjbodzo/review_system/review"
+)
+
+// PriorityRule assigns a priority to the reviews matching every condition it sets. A
+// rule setting no conditions matches every review.
+type PriorityRule struct {
+	Priority string `json:"priority"`
+
+	// MinRating and MaxRating match reviews rated within the given bounds, inclusive
+	MinRating *int `json:"minRating,omitempty"`
+	MaxRating *int `json:"maxRating,omitempty"`
+
+	// ProductIDs matches reviews of any of the given products
+	ProductIDs []int `json:"productIDs,omitempty"`
+
+	// NewProductDays matches reviews of products that went on sale within this many days
+	NewProductDays int `json:"newProductDays,omitempty"`
+
+	// VerifiedPurchase matches reviews whose author did, or didn't, order the product
+	VerifiedPurchase *bool `json:"verifiedPurchase,omitempty"`
+
+	// PublishedEdit matches edits of reviews that were, or weren't, already published
+	PublishedEdit *bool `json:"publishedEdit,omitempty"`
+
+	priority Priority
+}
+
+// PriorityRules decide which priority lane a saved review is queued in. The first rule
+// a review matches sets its priority, falling back to Default if it matches none.
+//
+// Rules are written as json, e.g.
+//
+//	{
+//	  "default": "normal",
+//	  "rules": [
+//	    {"priority": "high", "publishedEdit": true},
+//	    {"priority": "high", "newProductDays": 30},
+//	    {"priority": "high", "maxRating": 2},
+//	    {"priority": "low", "productIDs": [707, 708]}
+//	  ]
+//	}
+type PriorityRules struct {
+	Default string         `json:"default"`
+	Rules   []PriorityRule `json:"rules"`
+
+	def Priority
+}
+
+// LoadPriorityRules reads and validates the priority rules in the json file at path
+func LoadPriorityRules(path string) (*PriorityRules, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read priority rules\nError: %v", err)
+	}
+	return ParsePriorityRules(b)
+}
+
+// ParsePriorityRules parses and validates priority rules written as json
+func ParsePriorityRules(b []byte) (*PriorityRules, error) {
+	var rules PriorityRules
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("Unable to parse priority rules\nError: %v", err)
+	}
+
+	var err error
+	if rules.Default != "" {
+		if rules.def, err = ParsePriority(rules.Default); err != nil {
+			return nil, err
+		}
+	}
+	for i := range rules.Rules {
+		rule := &rules.Rules[i]
+		if rule.priority, err = ParsePriority(rule.Priority); err != nil {
+			return nil, fmt.Errorf("Invalid priority rule %d\nError: %v", i+1, err)
+		}
+		if rule.NewProductDays < 0 {
+			return nil, fmt.Errorf("Invalid priority rule %d\nError: newProductDays can't be negative", i+1)
+		}
+	}
+	return &rules, nil
+}
+
+// NeedsProduct reports whether any rule looks at the reviewed product, so callers can
+// skip looking it up otherwise
+func (r *PriorityRules) NeedsProduct() bool {
+	for _, rule := range r.Rules {
+		if rule.NewProductDays > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsPurchase reports whether any rule looks at whether the review's author bought the
+// product, so callers can skip looking it up otherwise
+func (r *PriorityRules) NeedsPurchase() bool {
+	for _, rule := range r.Rules {
+		if rule.VerifiedPurchase != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Prioritize returns the priority of the first rule the review matches. Previous is the
+// status the review had before it was saved, empty if it's new. The reviewed product may
+// be nil if it's unknown, in which case rules about the product don't match, and likewise
+// verified if it's unknown whether the review's author bought it.
+func (r *PriorityRules) Prioritize(rev *review.ProductReview, previous db.ReviewStatus, product *db.ProductRow,
+	verified *bool) Priority {
+	for _, rule := range r.Rules {
+		if rule.matches(rev, previous, product, verified) {
+			return rule.priority
+		}
+	}
+	return r.def
+}
+
+// matches reports whether the review meets every condition the rule sets
+func (rule *PriorityRule) matches(rev *review.ProductReview, previous db.ReviewStatus, product *db.ProductRow,
+	verified *bool) bool {
+	if rule.MinRating != nil && rev.Rating < *rule.MinRating {
+		return false
+	}
+	if rule.MaxRating != nil && rev.Rating > *rule.MaxRating {
+		return false
+	}
+	if len(rule.ProductIDs) > 0 {
+		found := false
+		for _, id := range rule.ProductIDs {
+			found = found || id == rev.ProductID
+		}
+		if !found {
+			return false
+		}
+	}
+	if rule.NewProductDays > 0 {
+		newSince := time.Now().AddDate(0, 0, -rule.NewProductDays)
+		if product == nil || product.SellStartDate.Before(newSince) {
+			return false
+		}
+	}
+	if rule.VerifiedPurchase != nil && (verified == nil || *verified != *rule.VerifiedPurchase) {
+		return false
+	}
+	if rule.PublishedEdit != nil && (previous == db.StatusApproved) != *rule.PublishedEdit {
+		return false
+	}
+	return true
+}
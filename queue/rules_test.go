@@ -0,0 +1,33 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/sjbodzo/review_system/db"
+	"github.com/sjbodzo/review_system/review"
+)
+
+func TestPriorityRulesPublishedEdit(t *testing.T) {
+	rules, err := ParsePriorityRules([]byte(`{
+		"default": "normal",
+		"rules": [
+			{"priority": "high", "publishedEdit": true},
+			{"priority": "low", "maxRating": 2}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("Unable to parse priority rules: %v", err)
+	}
+
+	rev := &review.ProductReview{ProductID: 707, Rating: 1}
+	for previous, expected := range map[db.ReviewStatus]Priority{
+		"":                         PriorityLow,
+		db.StatusPending:           PriorityLow,
+		db.StatusNeedsManualReview: PriorityLow,
+		db.StatusApproved:          PriorityHigh,
+	} {
+		if p := rules.Prioritize(rev, previous, nil, nil); p != expected {
+			t.Fatalf("Expected a review previously %q to be %s priority, got %s", previous, expected, p)
+		}
+	}
+}
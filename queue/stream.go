@@ -0,0 +1,706 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Modes a WorkerPool can keep its jobs in redis with
+const (
+	// ListMode queues jobs in redis lists, moving them from ReqQueue to ProcQueue as they're reserved
+	ListMode = "list"
+
+	// StreamMode queues jobs in a redis stream, read by the consumers of a consumer group
+	StreamMode = "stream"
+)
+
+// claimBatchSize caps how many entries a single XAUTOCLAIM claims at once
+const claimBatchSize = 100
+
+// PendingEntry is a stream entry delivered to a consumer that hasn't acked it yet
+type PendingEntry struct {
+	Stream     string        `json:"stream"`
+	EntryID    string        `json:"entryID"`
+	Consumer   string        `json:"consumer"`
+	Idle       time.Duration `json:"idle"`
+	Deliveries int           `json:"deliveries"`
+}
+
+// ConsumerInfo describes a consumer in the stream's consumer group
+type ConsumerInfo struct {
+	Name    string        `json:"name"`
+	Pending int           `json:"pending"`
+	Idle    time.Duration `json:"idle"`
+}
+
+// DefaultConsumer names this process as a stream consumer, unique to the host and process
+func DefaultConsumer() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "approverd"
+	}
+	return fmt.Sprint(host, "-", os.Getpid())
+}
+
+// entriesKey names the hash mapping each job ID to its entry in the stream, written as
+// the lane stream's name and the entry ID, separated by a space
+func entriesKey(stream string) string {
+	return stream + ":entries"
+}
+
+// entryRef refers to an entry in one of the lane streams, as "<stream> <entry ID>"
+func entryRef(stream string, entryID string) string {
+	return stream + " " + entryID
+}
+
+// splitEntryRef splits an entry reference into its lane stream and entry ID
+func splitEntryRef(ref string) (stream string, entryID string) {
+	i := strings.LastIndex(ref, " ")
+	if i < 0 {
+		return "", ref
+	}
+	return ref[:i], ref[i+1:]
+}
+
+// streamPushScript adds a job to its lane stream, recording which entry it went in.
+//
+// KEYS: lane stream, entries hash, signal. ARGV: job ID, job payload.
+var streamPushScript = redis.NewScript(3, `
+redis.replicate_commands()
+local entry = redis.call('XADD', KEYS[1], '*', 'id', ARGV[1], 'job', ARGV[2])
+redis.call('HSET', KEYS[2], ARGV[1], KEYS[1] .. ' ' .. entry)
+redis.call('LPUSH', KEYS[3], 1)
+redis.call('LTRIM', KEYS[3], 0, 0)
+return entry
+`)
+
+// streamAckScript acks and deletes a processed job's stream entry, returning whether the
+// entry was still pending. The entry stands for the reservation: once the reaper has
+// moved the job out of it, acking it does nothing, so the job's next entry is left alone.
+// Jobs without an entry are removed from the retry queue.
+//
+// KEYS: lane stream, entries hash, retry queue, jobs hash. ARGV: group, entry ID (empty
+// if none), job ID.
+var streamAckScript = redis.NewScript(4, `
+local n = 0
+if ARGV[2] ~= '' then
+	n = redis.call('XACK', KEYS[1], ARGV[1], ARGV[2])
+	if n == 0 then
+		return 0
+	end
+	redis.call('XDEL', KEYS[1], ARGV[2])
+end
+redis.call('HDEL', KEYS[2], ARGV[3])
+redis.call('ZREM', KEYS[3], ARGV[3])
+redis.call('HDEL', KEYS[4], ARGV[3])
+return n
+`)
+
+// streamRetryScript moves a pending job out of the stream into the retry queue, due at
+// the given time, storing its updated payload until it's due. The job is only scheduled
+// if its entry was still pending, so a job acked in the meantime isn't run twice.
+//
+// KEYS: lane stream, entries hash, retry queue, jobs hash. ARGV: group, entry ID, job ID,
+// retried payload, due time.
+var streamRetryScript = redis.NewScript(4, `
+if redis.call('XACK', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call('XDEL', KEYS[1], ARGV[2])
+redis.call('HDEL', KEYS[2], ARGV[3])
+redis.call('HSET', KEYS[4], ARGV[3], ARGV[4])
+redis.call('ZADD', KEYS[3], ARGV[5], ARGV[3])
+return 1
+`)
+
+// streamDeadLetterScript moves a pending job out of the stream onto the dead letter queue.
+// The job is only dead lettered if its entry was still pending.
+//
+// KEYS: lane stream, entries hash, dead letter queue. ARGV: group, entry ID, job ID, dead letter.
+var streamDeadLetterScript = redis.NewScript(3, `
+if redis.call('XACK', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call('XDEL', KEYS[1], ARGV[2])
+if ARGV[3] ~= '' then
+	redis.call('HDEL', KEYS[2], ARGV[3])
+end
+redis.call('LPUSH', KEYS[3], ARGV[4])
+return 1
+`)
+
+// streamPromoteScript adds up to a batch of jobs whose retry is due back to their lane stream.
+//
+// KEYS: retry queue, entries hash, jobs hash, signal, then the high, normal and low
+// priority lane streams. ARGV: current time, batch size.
+var streamPromoteScript = redis.NewScript(7, `
+redis.replicate_commands()
+`+laneLua+`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, id in ipairs(due) do
+	redis.call('ZREM', KEYS[1], id)
+	local payload = redis.call('HGET', KEYS[3], id)
+	if payload then
+		redis.call('HDEL', KEYS[3], id)
+		local stream = lane(payload)
+		local entry = redis.call('XADD', stream, '*', 'id', id, 'job', payload)
+		redis.call('HSET', KEYS[2], id, stream .. ' ' .. entry)
+	end
+end
+if #due > 0 then
+	redis.call('LPUSH', KEYS[4], 1)
+	redis.call('LTRIM', KEYS[4], 0, 0)
+end
+return #due
+`)
+
+// streamReplayScript moves a dead letter back onto its lane stream as its original job.
+//
+// KEYS: dead letter queue, entries hash, signal, then the high, normal and low priority
+// lane streams. ARGV: dead letter, job ID, job payload.
+var streamReplayScript = redis.NewScript(6, `
+redis.replicate_commands()
+`+laneLua+`
+local n = redis.call('LREM', KEYS[1], 1, ARGV[1])
+if n > 0 then
+	local stream = lane(ARGV[3])
+	local entry = redis.call('XADD', stream, '*', 'id', ARGV[2], 'job', ARGV[3])
+	redis.call('HSET', KEYS[2], ARGV[2], stream .. ' ' .. entry)
+	redis.call('LPUSH', KEYS[3], 1)
+	redis.call('LTRIM', KEYS[3], 0, 0)
+end
+return n
+`)
+
+// streamRemoveScript removes a job from its lane stream or the retry queue, returning
+// whether it was there.
+//
+// KEYS: lane stream, entries hash, retry queue, jobs hash. ARGV: group, entry ID (empty
+// if none), job ID.
+var streamRemoveScript = redis.NewScript(4, `
+local n = redis.call('ZREM', KEYS[3], ARGV[3]) + redis.call('HDEL', KEYS[4], ARGV[3])
+if ARGV[2] ~= '' then
+	redis.call('XACK', KEYS[1], ARGV[1], ARGV[2])
+	n = n + redis.call('XDEL', KEYS[1], ARGV[2])
+end
+redis.call('HDEL', KEYS[2], ARGV[3])
+return n
+`)
+
+// streamRequeueScript adds a job back to the end of its lane stream, whether it's
+// pending or waiting on a retry, returning whether there was such a job.
+//
+// KEYS: lane stream the job is in, entries hash, retry queue, jobs hash, signal, then
+// the high, normal and low priority lane streams. ARGV: group, entry ID (empty if none),
+// job ID.
+var streamRequeueScript = redis.NewScript(8, `
+redis.replicate_commands()
+`+laneLua+`
+local payload = redis.call('HGET', KEYS[4], ARGV[3])
+if ARGV[2] ~= '' then
+	local found = redis.call('XRANGE', KEYS[1], ARGV[2], ARGV[2])
+	if #found > 0 then
+		for i = 1, #found[1][2], 2 do
+			if found[1][2][i] == 'job' then
+				payload = found[1][2][i + 1]
+			end
+		end
+	end
+	redis.call('XACK', KEYS[1], ARGV[1], ARGV[2])
+	redis.call('XDEL', KEYS[1], ARGV[2])
+end
+if not payload then
+	return 0
+end
+redis.call('ZREM', KEYS[3], ARGV[3])
+redis.call('HDEL', KEYS[4], ARGV[3])
+local stream = lane(payload)
+local entry = redis.call('XADD', stream, '*', 'id', ARGV[3], 'job', payload)
+redis.call('HSET', KEYS[2], ARGV[3], stream .. ' ' .. entry)
+redis.call('LPUSH', KEYS[5], 1)
+redis.call('LTRIM', KEYS[5], 0, 0)
+return 1
+`)
+
+// streamReleaseScript moves a pending job out of its entry and adds it back to the end of
+// its lane stream, returning whether the entry was still pending.
+//
+// KEYS: lane stream, entries hash, signal, then the high, normal and low priority lane
+// streams. ARGV: group, entry ID, job ID.
+var streamReleaseScript = redis.NewScript(6, `
+redis.replicate_commands()
+`+laneLua+`
+local found = redis.call('XRANGE', KEYS[1], ARGV[2], ARGV[2])
+if #found == 0 or redis.call('XACK', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call('XDEL', KEYS[1], ARGV[2])
+local payload
+for i = 1, #found[1][2], 2 do
+	if found[1][2][i] == 'job' then
+		payload = found[1][2][i + 1]
+	end
+end
+local stream = lane(payload)
+local entry = redis.call('XADD', stream, '*', 'id', ARGV[3], 'job', payload)
+redis.call('HSET', KEYS[2], ARGV[3], stream .. ' ' .. entry)
+redis.call('LPUSH', KEYS[3], 1)
+redis.call('LTRIM', KEYS[3], 0, 0)
+return 1
+`)
+
+// streamEntry is an entry read from the stream
+type streamEntry struct {
+	ID     string
+	Fields map[string][]byte // nil if the entry was deleted while pending
+}
+
+// parseEntries parses the entries in a reply from XRANGE, or in an XREADGROUP stream
+func parseEntries(reply interface{}, err error) ([]streamEntry, error) {
+	raw, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]streamEntry, 0, len(raw))
+	for _, r := range raw {
+		parts, err := redis.Values(r, nil)
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("Unexpected stream entry %v", r)
+		}
+		entry := streamEntry{}
+		if entry.ID, err = redis.String(parts[0], nil); err != nil {
+			return nil, err
+		}
+		if parts[1] != nil {
+			fields, err := redis.ByteSlices(parts[1], nil)
+			if err != nil {
+				return nil, err
+			}
+			entry.Fields = make(map[string][]byte)
+			for i := 0; i+1 < len(fields); i += 2 {
+				entry.Fields[string(fields[i])] = fields[i+1]
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// isRedisErr reports whether err is a redis error reply starting with the given code
+func isRedisErr(err error, code string) bool {
+	e, ok := err.(redis.Error)
+	return ok && strings.HasPrefix(string(e), code)
+}
+
+// createGroup creates the consumer group on a lane stream, along with the stream if need
+// be. Entries already in the stream are delivered to the new group.
+func (w *WorkerPool) createGroup(c redis.Conn, stream string) error {
+	_, err := c.Do("XGROUP", "CREATE", stream, w.Group, "0", "MKSTREAM")
+	if err != nil && !isRedisErr(err, "BUSYGROUP") {
+		return fmt.Errorf("Unable to create consumer group %s\nError: %v", w.Group, err)
+	}
+	return nil
+}
+
+// pushEntry adds the job to the end of its lane stream
+func (w *WorkerPool) pushEntry(c redis.Conn, job *ProductReviewJob, payload []byte) error {
+	_, err := streamPushScript.Do(c, laneKey(w.Stream, job.Priority), entriesKey(w.Stream), signalKey(w.Stream),
+		job.ID, payload)
+	if err != nil {
+		return fmt.Errorf("Unable to add job to stream\nError: %v", err)
+	}
+	return nil
+}
+
+// reserveEntry reads the next new entry for this consumer from the first lane stream with
+// one, looking through the lanes in an order weighted by LaneWeights, and waiting for up
+// to BlockTimeout if every lane is empty. The entry stays pending for this consumer until
+// it's acked, retried or dead lettered, or claimed by another consumer once it's been
+// idle for LeaseTimeout.
+func (w *WorkerPool) reserveEntry(c redis.Conn) (*ProductReviewJob, error) {
+	var entry *streamEntry
+	var stream string
+	err := w.waitForJob(c, signalKey(w.Stream), func() (found bool, err error) {
+		for _, p := range w.scheduler.order(w.LaneWeights) {
+			stream = laneKey(w.Stream, p)
+			if entry, err = w.readEntry(c, stream); err != nil || entry != nil {
+				return entry != nil, err
+			}
+		}
+		return false, nil
+	})
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	// there may be more entries behind this one, so wake up another worker to look
+	c.Send("LPUSH", signalKey(w.Stream), 1)
+	if _, err := c.Do("LTRIM", signalKey(w.Stream), 0, 0); err != nil {
+		return nil, fmt.Errorf("Unable to signal stream\nError: %v", err)
+	}
+
+	job, err := entryJob(stream, *entry)
+	if err != nil {
+		reason := fmt.Sprintf("Unable to parse job\nError: %v", err)
+		dlErr := w.deadLetterEntry(c, stream, entry.ID, string(entry.Fields["id"]), entry.Fields["job"], reason)
+		if dlErr != nil {
+			return nil, dlErr
+		}
+		return nil, errors.New(reason)
+	}
+	return job, nil
+}
+
+// readEntry reads the next new entry in a lane stream for this consumer, without waiting,
+// returning nil if there's none
+func (w *WorkerPool) readEntry(c redis.Conn, stream string) (*streamEntry, error) {
+	read := func() (interface{}, error) {
+		return c.Do("XREADGROUP", "GROUP", w.Group, w.Consumer, "COUNT", 1, "STREAMS", stream, ">")
+	}
+	reply, err := read()
+	if isRedisErr(err, "NOGROUP") {
+		if err := w.createGroup(c, stream); err != nil {
+			return nil, err
+		}
+		reply, err = read()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read from stream\nError: %v", err)
+	} else if reply == nil {
+		return nil, nil
+	}
+
+	streams, err := redis.Values(reply, nil)
+	if err != nil || len(streams) != 1 {
+		return nil, fmt.Errorf("Unexpected reply from stream %v", reply)
+	}
+	parts, err := redis.Values(streams[0], nil)
+	if err != nil || len(parts) != 2 {
+		return nil, fmt.Errorf("Unexpected reply from stream %v", reply)
+	}
+	entries, err := parseEntries(parts[1], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse stream entry\nError: %v", err)
+	} else if len(entries) == 0 {
+		return nil, nil
+	}
+	return &entries[0], nil
+}
+
+// entryJob parses the job in an entry of the given lane stream
+func entryJob(stream string, entry streamEntry) (*ProductReviewJob, error) {
+	if entry.Fields == nil {
+		return nil, fmt.Errorf("Entry %s was deleted", entry.ID)
+	}
+	var job ProductReviewJob
+	if err := json.Unmarshal(entry.Fields["job"], &job); err != nil {
+		return nil, err
+	}
+	if id := string(entry.Fields["id"]); id != "" {
+		job.ID = id
+	}
+	job.entryID = entryRef(stream, entry.ID)
+	return &job, nil
+}
+
+// entryOf returns the lane stream and ID of the entry the job was reserved from, looking
+// them up by the job's ID for jobs that didn't come from Reserve. It returns an empty
+// entry ID if the job has no entry in the stream.
+func (w *WorkerPool) entryOf(c redis.Conn, job *ProductReviewJob) (stream string, entryID string, err error) {
+	ref := job.entryID
+	if ref == "" {
+		ref, err = redis.String(c.Do("HGET", entriesKey(w.Stream), job.ID))
+		if err == redis.ErrNil {
+			return laneKey(w.Stream, job.Priority), "", nil
+		} else if err != nil {
+			return "", "", fmt.Errorf("Unable to look up job %s\nError: %v", job.ID, err)
+		}
+	}
+	stream, entryID = splitEntryRef(ref)
+	return stream, entryID, nil
+}
+
+// ackEntry acks and deletes the job's stream entry once it's been processed
+func (w *WorkerPool) ackEntry(c redis.Conn, job *ProductReviewJob) error {
+	stream, entry, err := w.entryOf(c, job)
+	if err != nil {
+		return err
+	}
+	_, err = streamAckScript.Do(c, stream, entriesKey(w.Stream), w.RetryQueue, w.JobsKey, w.Group, entry, job.ID)
+	if err != nil {
+		return fmt.Errorf("Unable to ack job\nError: %v", err)
+	}
+	return nil
+}
+
+// retryEntry moves the job out of the stream and into the retry queue with its attempts
+// counter incremented, due once its Backoff has passed
+func (w *WorkerPool) retryEntry(c redis.Conn, job *ProductReviewJob) (retried bool, err error) {
+	stream, entry, err := w.entryOf(c, job)
+	if err != nil || entry == "" {
+		return false, err
+	}
+
+	next := *job
+	next.Attempts++
+	payload, err := json.Marshal(&next)
+	if err != nil {
+		return false, fmt.Errorf("Unable to marshal review job\nError: %v", err)
+	}
+
+	due := time.Now().Add(w.Backoff.Delay(next.Attempts)).UnixNano() / int64(time.Millisecond)
+	n, err := redis.Int(streamRetryScript.Do(c, stream, entriesKey(w.Stream), w.RetryQueue, w.JobsKey,
+		w.Group, entry, job.ID, payload, due))
+	if err != nil {
+		return false, fmt.Errorf("Unable to schedule job for retry\nError: %v", err)
+	}
+	return n > 0, nil
+}
+
+// deadLetterEntry moves the given entry of a lane stream onto the dead letter queue, along with its payload
+func (w *WorkerPool) deadLetterEntry(c redis.Conn, stream string, entry string, id string, payload []byte,
+	reason string) error {
+	b, err := w.newDeadLetter(payload, reason)
+	if err != nil {
+		return err
+	}
+	_, err = streamDeadLetterScript.Do(c, stream, entriesKey(w.Stream), w.DeadLetterQueue, w.Group, entry, id, b)
+	if err != nil {
+		return fmt.Errorf("Unable to dead letter job\nError: %v", err)
+	}
+	return nil
+}
+
+// removeEntry removes the job with the given ID from its lane stream or the retry queue
+func (w *WorkerPool) removeEntry(c redis.Conn, id string) (removed bool, err error) {
+	stream, entry, err := w.entryOf(c, &ProductReviewJob{ID: id})
+	if err != nil {
+		return false, err
+	}
+	n, err := redis.Int(streamRemoveScript.Do(c, stream, entriesKey(w.Stream), w.RetryQueue, w.JobsKey,
+		w.Group, entry, id))
+	return n > 0, err
+}
+
+// releaseEntry adds a reserved job back to the end of its lane stream, unless the entry it
+// was reserved from isn't pending anymore
+func (w *WorkerPool) releaseEntry(c redis.Conn, job *ProductReviewJob) (released bool, err error) {
+	stream, entry, err := w.entryOf(c, job)
+	if err != nil || entry == "" {
+		return false, err
+	}
+	keys := append([]interface{}{stream, entriesKey(w.Stream), signalKey(w.Stream)}, laneKeys(w.Stream)...)
+	n, err := redis.Int(streamReleaseScript.Do(c, append(keys, w.Group, entry, job.ID)...))
+	return n > 0, err
+}
+
+// requeueEntry adds the job with the given ID back to the end of its lane stream
+func (w *WorkerPool) requeueEntry(c redis.Conn, id string) (requeued bool, err error) {
+	stream, entry, err := w.entryOf(c, &ProductReviewJob{ID: id})
+	if err != nil {
+		return false, err
+	}
+	keys := append([]interface{}{stream, entriesKey(w.Stream), w.RetryQueue, w.JobsKey, signalKey(w.Stream)},
+		laneKeys(w.Stream)...)
+	n, err := redis.Int(streamRequeueScript.Do(c, append(keys, w.Group, entry, id)...))
+	return n > 0, err
+}
+
+// ReapStream claims the stream entries that have been pending for longer than
+// LeaseTimeout, e.g. because the consumer they were delivered to died, and schedules
+// them for a retry, incrementing their attempts counter. Jobs that have run out of
+// attempts are dead lettered instead.
+func (w *WorkerPool) ReapStream() (reaped int, err error) {
+	c := w.pool.Get()
+	defer c.Close()
+
+	for _, p := range lanes {
+		n, err := w.reapLane(c, laneKey(w.Stream, p))
+		reaped += n
+		if err != nil {
+			return reaped, err
+		}
+	}
+	return reaped, nil
+}
+
+// reapLane claims and reaps the idle entries of a single lane stream
+func (w *WorkerPool) reapLane(c redis.Conn, stream string) (reaped int, err error) {
+	minIdle := int64(w.LeaseTimeout / time.Millisecond)
+	start := "0-0"
+	for {
+		reply, err := redis.Values(c.Do("XAUTOCLAIM", stream, w.Group, w.Consumer, minIdle, start,
+			"COUNT", claimBatchSize))
+		if isRedisErr(err, "NOGROUP") {
+			return reaped, nil // nothing's been read yet, so nothing can be pending
+		} else if err != nil || len(reply) < 2 {
+			return reaped, fmt.Errorf("Unable to claim idle stream entries\nError: %v", err)
+		}
+		if start, err = redis.String(reply[0], nil); err != nil {
+			return reaped, err
+		}
+		entries, err := parseEntries(reply[1], nil)
+		if err != nil {
+			return reaped, fmt.Errorf("Unable to parse stream entry\nError: %v", err)
+		}
+
+		for _, entry := range entries {
+			if entry.Fields == nil {
+				// deleted while pending, so there's nothing left to process
+				if _, err := c.Do("XACK", stream, w.Group, entry.ID); err != nil {
+					return reaped, fmt.Errorf("Unable to ack job\nError: %v", err)
+				}
+				continue
+			}
+
+			job, err := entryJob(stream, entry)
+			if err != nil || job.Attempts+1 >= w.MaxAttempts {
+				var reason string
+				if err != nil {
+					reason = fmt.Sprintf("Lease expired on job that can't be parsed\nError: %v", err)
+				} else {
+					reason = fmt.Sprintf("Lease expired after %d attempts", job.Attempts+1)
+				}
+				err = w.deadLetterEntry(c, stream, entry.ID, string(entry.Fields["id"]), entry.Fields["job"], reason)
+				if err != nil {
+					return reaped, err
+				}
+				continue
+			}
+
+			retried, err := w.retryEntry(c, job)
+			if err != nil {
+				return reaped, err
+			}
+			if retried {
+				reaped++
+			}
+		}
+
+		if start == "0-0" {
+			return reaped, nil
+		}
+	}
+}
+
+// PromoteToStream adds the jobs in the retry queue whose backoff has passed back to their
+// lane stream, returning how many were added
+func (w *WorkerPool) PromoteToStream() (promoted int, err error) {
+	c := w.pool.Get()
+	defer c.Close()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	keys := append([]interface{}{w.RetryQueue, entriesKey(w.Stream), w.JobsKey, signalKey(w.Stream)},
+		laneKeys(w.Stream)...)
+	for {
+		n, err := redis.Int(streamPromoteScript.Do(c, append(keys, now, promoteBatchSize)...))
+		if err != nil {
+			return promoted, fmt.Errorf("Unable to promote jobs due for retry\nError: %v", err)
+		}
+		promoted += n
+		if n < promoteBatchSize {
+			return promoted, nil
+		}
+	}
+}
+
+// Consumers lists the consumers in the stream's consumer group, totalling what's pending
+// for them across the lane streams
+func (w *WorkerPool) Consumers() ([]ConsumerInfo, error) {
+	c := w.pool.Get()
+	defer c.Close()
+
+	var consumers []ConsumerInfo
+	byName := make(map[string]int)
+	for _, p := range lanes {
+		raw, err := redis.Values(c.Do("XINFO", "CONSUMERS", laneKey(w.Stream, p), w.Group))
+		if isRedisErr(err, "NOGROUP") || isRedisErr(err, "ERR no such key") {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Unable to list consumers\nError: %v", err)
+		}
+
+		for _, r := range raw {
+			fields, err := redis.Values(r, nil)
+			if err != nil {
+				return nil, fmt.Errorf("Unexpected consumer info %v", r)
+			}
+			var info ConsumerInfo
+			for i := 0; i+1 < len(fields); i += 2 {
+				key, _ := redis.String(fields[i], nil)
+				switch key {
+				case "name":
+					info.Name, _ = redis.String(fields[i+1], nil)
+				case "pending":
+					info.Pending, _ = redis.Int(fields[i+1], nil)
+				case "idle":
+					idle, _ := redis.Int64(fields[i+1], nil)
+					info.Idle = time.Duration(idle) * time.Millisecond
+				}
+			}
+
+			if i, ok := byName[info.Name]; ok {
+				consumers[i].Pending += info.Pending
+				if info.Idle < consumers[i].Idle {
+					consumers[i].Idle = info.Idle
+				}
+				continue
+			}
+			byName[info.Name] = len(consumers)
+			consumers = append(consumers, info)
+		}
+	}
+	return consumers, nil
+}
+
+// PendingEntries lists up to count entries of each lane stream that have been delivered
+// to a consumer but not acked yet, from the highest priority lane down, oldest first
+func (w *WorkerPool) PendingEntries(count int) ([]PendingEntry, error) {
+	c := w.pool.Get()
+	defer c.Close()
+
+	var pending []PendingEntry
+	for _, p := range lanes {
+		stream := laneKey(w.Stream, p)
+		raw, err := redis.Values(c.Do("XPENDING", stream, w.Group, "-", "+", count))
+		if isRedisErr(err, "NOGROUP") {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Unable to list pending entries\nError: %v", err)
+		}
+
+		for _, r := range raw {
+			fields, err := redis.Values(r, nil)
+			if err != nil || len(fields) != 4 {
+				return nil, fmt.Errorf("Unexpected pending entry %v", r)
+			}
+			entry := PendingEntry{Stream: stream}
+			var idle int64
+			if _, err := redis.Scan(fields, &entry.EntryID, &entry.Consumer, &idle, &entry.Deliveries); err != nil {
+				return nil, fmt.Errorf("Unexpected pending entry %v", r)
+			}
+			entry.Idle = time.Duration(idle) * time.Millisecond
+			pending = append(pending, entry)
+		}
+	}
+	return pending, nil
+}
+
+// StreamJob returns the job in the given entry of a lane stream
+func (w *WorkerPool) StreamJob(stream string, entryID string) (*ProductReviewJob, error) {
+	c := w.pool.Get()
+	defer c.Close()
+	entries, err := parseEntries(c.Do("XRANGE", stream, entryID, entryID))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read stream entry %s\nError: %v", entryID, err)
+	} else if len(entries) == 0 {
+		return nil, fmt.Errorf("No stream entry %s", entryID)
+	}
+	return entryJob(stream, entries[0])
+}
@@ -0,0 +1,93 @@
+package review
+
+// ahoCorasick finds every occurrence of a set of keywords in a text in a single pass,
+// however many keywords there are
+type ahoCorasick struct {
+	nodes   []acNode
+	lengths []int // of each keyword
+}
+
+// acNode is a state of the automaton: the keyword prefix spelled out by the path to it
+type acNode struct {
+	next map[byte]int32
+	fail int32
+
+	// out lists the keywords ending at this state, including those ending at its fail states
+	out []int
+}
+
+// acMatch is where keyword lies in the searched text, in bytes
+type acMatch struct {
+	keyword    int
+	start, end int
+}
+
+// newAhoCorasick builds the automaton for the keywords, which are reported by their index
+func newAhoCorasick(keywords []string) *ahoCorasick {
+	ac := &ahoCorasick{nodes: []acNode{{}}, lengths: make([]int, len(keywords))}
+	for i, keyword := range keywords {
+		ac.lengths[i] = len(keyword)
+		state := int32(0)
+		for j := 0; j < len(keyword); j++ {
+			next, ok := ac.nodes[state].next[keyword[j]]
+			if !ok {
+				next = int32(len(ac.nodes))
+				ac.nodes = append(ac.nodes, acNode{})
+				if ac.nodes[state].next == nil {
+					ac.nodes[state].next = make(map[byte]int32)
+				}
+				ac.nodes[state].next[keyword[j]] = next
+			}
+			state = next
+		}
+		ac.nodes[state].out = append(ac.nodes[state].out, i)
+	}
+
+	// link each state to the longest proper suffix of it that's also a state, breadth first
+	// so that a state's suffixes are linked before it is
+	queue := make([]int32, 0, len(ac.nodes))
+	for _, child := range ac.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for b, child := range ac.nodes[state].next {
+			fail := ac.nodes[state].fail
+			for {
+				if next, ok := ac.nodes[fail].next[b]; ok {
+					ac.nodes[child].fail = next
+					break
+				} else if fail == 0 {
+					break
+				}
+				fail = ac.nodes[fail].fail
+			}
+			ac.nodes[child].out = append(ac.nodes[child].out, ac.nodes[ac.nodes[child].fail].out...)
+			queue = append(queue, child)
+		}
+	}
+	return ac
+}
+
+// find returns every occurrence of the keywords in text, overlapping ones included, in
+// the order they end
+func (ac *ahoCorasick) find(text string) []acMatch {
+	var matches []acMatch
+	state := int32(0)
+	for i := 0; i < len(text); i++ {
+		for {
+			if next, ok := ac.nodes[state].next[text[i]]; ok {
+				state = next
+				break
+			} else if state == 0 {
+				break
+			}
+			state = ac.nodes[state].fail
+		}
+		for _, keyword := range ac.nodes[state].out {
+			matches = append(matches, acMatch{keyword: keyword, start: i + 1 - ac.lengths[keyword], end: i + 1})
+		}
+	}
+	return matches
+}
@@ -0,0 +1,137 @@
+package review
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Outcome is what a reviewer decided should happen to a product review
+type Outcome string
+
+// Outcomes a reviewer can decide on
+const (
+	OutcomeApprove Outcome = "approve"
+	OutcomeReject  Outcome = "reject"
+	OutcomeManual  Outcome = "manual" // left for a moderator to decide
+)
+
+// Evidence is something a reviewer found in a product review that its decision rests on
+type Evidence struct {
+	// Term is the text that was matched, as it appears in the review
+	Term string `json:"term"`
+
+	// Position is the character offset the term starts at in the review, counting from 0
+	Position int `json:"position"`
+
+	// Detail says what the term matched, if that isn't obvious from the term itself
+	Detail string `json:"detail,omitempty"`
+}
+
+// Decision is a single reviewer's verdict on a product review, and why it was made
+type Decision struct {
+	Reviewer   string     `json:"reviewer"`
+	Outcome    Outcome    `json:"outcome"`
+	Reason     string     `json:"reason,omitempty"`
+	Evidence   []Evidence `json:"evidence,omitempty"`
+	Confidence float64    `json:"confidence"` // 0 to 1
+
+	// Risk is how likely the reviewer judges the review to break our guidelines, from 0
+	// to 1: its confidence if it rejected the review, the rest if it approved it, and a
+	// half if it left the review to a moderator
+	Risk float64 `json:"risk"`
+
+	// Weight is how much Risk counts towards the verdict when reviewers are scored
+	Weight float64 `json:"weight,omitempty"`
+
+	// Lexicon is the version of the terms the reviewer looked for, if it uses a Lexicon
+	Lexicon string `json:"lexicon,omitempty"`
+
+	// Language is the language the review was taken to be in, declared or detected, if
+	// the reviewer cares
+	Language string `json:"language,omitempty"`
+
+	// VerifiedPurchase is whether the reviewer bought the product, if the reviewer checked
+	VerifiedPurchase *bool `json:"verifiedPurchase,omitempty"`
+}
+
+// Decider is a Reviewer that explains its decisions. Reviewers that aren't Deciders are
+// treated as fully confident in whatever they return from Review.
+type Decider interface {
+	Reviewer
+	Decide(pr *ProductReview) Decision
+}
+
+// Verdict combines the decisions of every reviewer a product review went through
+type Verdict struct {
+	Approved  bool       `json:"approved"`
+	Outcome   Outcome    `json:"outcome"`
+	Reason    string     `json:"reason,omitempty"`
+	Score     float64    `json:"score,omitempty"` // the weighted risk, when reviewers are scored
+	Decisions []Decision `json:"decisions"`
+}
+
+// decide has the reviewer decide on the product review
+func decide(reviewer Reviewer, pr *ProductReview) Decision {
+	var decision Decision
+	if d, ok := reviewer.(Decider); ok {
+		decision = d.Decide(pr)
+	} else {
+		decision = Decision{Reviewer: fmt.Sprintf("%T", reviewer), Outcome: OutcomeApprove, Confidence: 1}
+		if !reviewer.Review(pr) {
+			decision.Outcome = OutcomeReject
+		}
+	}
+
+	switch decision.Outcome {
+	case OutcomeReject:
+		decision.Risk = decision.Confidence
+	case OutcomeManual:
+		decision.Risk = 0.5
+	default:
+		decision.Risk = 1 - decision.Confidence
+	}
+	return decision
+}
+
+// VerifiedPurchase returns whether the reviewer bought the product, as the first decision
+// that checked found, or nil if none did
+func (v *Verdict) VerifiedPurchase() *bool {
+	for _, d := range v.Decisions {
+		if d.VerifiedPurchase != nil {
+			return d.VerifiedPurchase
+		}
+	}
+	return nil
+}
+
+// Rejections returns the decisions that rejected the review
+func (v *Verdict) Rejections() []Decision {
+	var rejected []Decision
+	for _, d := range v.Decisions {
+		if d.Outcome == OutcomeReject {
+			rejected = append(rejected, d)
+		}
+	}
+	return rejected
+}
+
+// Explain summarizes why the review was rejected, in a form fit to show its author, or
+// returns an empty string if it wasn't
+func (v *Verdict) Explain() string {
+	var reasons []string
+	for _, d := range v.Rejections() {
+		reason := d.Reason
+		if reason == "" {
+			reason = "Rejected by " + d.Reviewer
+		}
+		var terms []string
+		for _, e := range d.Evidence {
+			terms = append(terms, fmt.Sprintf("%q at position %d", e.Term, e.Position))
+		}
+		if terms != nil {
+			reason += ": " + strings.Join(terms, ", ")
+		}
+		reasons = append(reasons, reason)
+	}
+	return strings.Join(reasons, "\n")
+}
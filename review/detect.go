@@ -0,0 +1,110 @@
+package review
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Detector guesses which language a text is written in, returning its culture id, e.g.
+// "en" or "fr", or an empty string if it can't tell
+type Detector interface {
+	Detect(text string) (language string, confidence float64)
+}
+
+// StopwordDetector is an offline Detector for the languages in Production.Culture. Texts
+// mostly written in a non-latin script are put down to the language using it, and the
+// rest to the language whose common short words they use the most.
+type StopwordDetector struct {
+	// Scripts maps the non-latin scripts to the language they're taken to be written in
+	Scripts map[string]*unicode.RangeTable
+
+	// Stopwords lists each latin language's most common words, lower cased
+	Stopwords map[string][]string
+
+	// MinHits is how many stopwords a text needs to use before it's put down to a language
+	MinHits int
+
+	stopwords map[string][]string // languages using each stopword
+}
+
+// DefaultDetector returns a StopwordDetector for english, french, spanish, arabic, hebrew,
+// thai and traditional chinese
+func DefaultDetector() *StopwordDetector {
+	return NewStopwordDetector(map[string]*unicode.RangeTable{
+		"ar":     unicode.Arabic,
+		"he":     unicode.Hebrew,
+		"th":     unicode.Thai,
+		"zh-cht": unicode.Han,
+	}, map[string][]string{
+		"en": {"the", "and", "is", "it", "of", "to", "in", "this", "that", "with", "for", "my",
+			"was", "not", "but", "very", "have", "i", "you", "are", "on", "great", "good"},
+		"fr": {"le", "la", "les", "et", "est", "un", "une", "de", "des", "du", "je", "pas", "très",
+			"pour", "avec", "ce", "cette", "il", "qui", "que", "mais", "sur", "bien", "mon"},
+		"es": {"el", "la", "los", "las", "y", "es", "un", "una", "de", "del", "que", "muy", "por",
+			"para", "con", "no", "pero", "lo", "mi", "este", "esta", "se", "bien", "bueno"},
+	})
+}
+
+// NewStopwordDetector returns a StopwordDetector for the given scripts and stopwords,
+// needing at least 2 stopwords to tell a latin language
+func NewStopwordDetector(scripts map[string]*unicode.RangeTable, stopwords map[string][]string) *StopwordDetector {
+	d := &StopwordDetector{
+		Scripts:   scripts,
+		Stopwords: stopwords,
+		MinHits:   2,
+		stopwords: make(map[string][]string),
+	}
+	for language, words := range stopwords {
+		for _, w := range words {
+			d.stopwords[w] = append(d.stopwords[w], language)
+		}
+	}
+	return d
+}
+
+// Detect guesses the text's language, with a confidence of the share of its letters in the
+// language's script, or of its stopwords that are the language's
+func (d *StopwordDetector) Detect(text string) (language string, confidence float64) {
+	letters := 0
+	scripts := make(map[string]int)
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		for lang, script := range d.Scripts {
+			if unicode.Is(script, r) {
+				scripts[lang]++
+				break
+			}
+		}
+	}
+	for lang, n := range scripts {
+		if 2*n > letters {
+			return lang, float64(n) / float64(letters)
+		}
+	}
+
+	hits, total := make(map[string]int), 0
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) })
+	for _, w := range words {
+		for _, lang := range d.stopwords[w] {
+			hits[lang]++
+			total++
+		}
+	}
+	best, runnerUp := "", 0
+	for lang, n := range hits {
+		switch {
+		case n > hits[best]:
+			runnerUp = hits[best]
+			best = lang
+		case n > runnerUp:
+			runnerUp = n
+		}
+	}
+	if best == "" || hits[best] < d.MinHits || hits[best] == runnerUp {
+		return "", 0
+	}
+	return best, float64(hits[best]) / float64(total)
+}
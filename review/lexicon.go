@@ -0,0 +1,109 @@
+package review
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// Lexicon is the set of terms a LanguageReviewer looks for, which can be loaded from a
+// json file or the moderation terms table and swapped into reviewers as they run. Terms
+// mean what they do in the LanguageReviewer's fields of the same names.
+type Lexicon struct {
+	// Version names this set of terms in the decisions made with it. It's derived from the
+	// terms themselves if left empty, so it changes whenever they do.
+	Version string `json:"version,omitempty"`
+
+	Blacklist  []string `json:"blacklist"`
+	Allowlist  []string `json:"allowlist,omitempty"`
+	Substrings []string `json:"substrings,omitempty"`
+	Wildcards  []string `json:"wildcards,omitempty"`
+	Patterns   []string `json:"patterns,omitempty"`
+
+	// Locales holds more terms for reviews in particular languages, keyed by their culture
+	// id in Production.Culture, e.g. "fr". Reviews in a language are checked for its terms
+	// as well as the ones above, which apply to every language.
+	Locales map[string]*Lexicon `json:"locales,omitempty"`
+}
+
+// LexiconLoader loads the latest lexicon from wherever it's kept
+type LexiconLoader func() (*Lexicon, error)
+
+// LexiconUser is a Reviewer whose terms can be replaced while it's in use
+type LexiconUser interface {
+	SetLexicon(lex *Lexicon) error
+}
+
+// LoadLexiconFile reads the lexicon in the json file at path
+func LoadLexiconFile(path string) (*Lexicon, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read lexicon\nError: %v", err)
+	}
+	var lex Lexicon
+	if err := json.Unmarshal(b, &lex); err != nil {
+		return nil, fmt.Errorf("Unable to parse lexicon\nError: %v", err)
+	}
+	lex.SetVersion()
+	return &lex, nil
+}
+
+// SetVersion derives the lexicon's version from its terms, unless it already has one
+func (lex *Lexicon) SetVersion() {
+	if lex.Version != "" {
+		return
+	}
+	b, _ := json.Marshal(lex)
+	sum := sha256.Sum256(b)
+	lex.Version = hex.EncodeToString(sum[:6])
+}
+
+// Size counts the lexicon's terms, those of its locales included
+func (lex *Lexicon) Size() int {
+	n := len(lex.Blacklist) + len(lex.Allowlist) + len(lex.Substrings) + len(lex.Wildcards) + len(lex.Patterns)
+	for _, locale := range lex.Locales {
+		if locale != nil {
+			n += locale.Size()
+		}
+	}
+	return n
+}
+
+// WatchLexicon loads the lexicon every interval, and whenever reload receives, applying it
+// if its version differs from the last one applied, starting from current. A lexicon that
+// fails to load or apply is logged, and the last one stays in use. It returns once ctx is done.
+func WatchLexicon(ctx context.Context, load LexiconLoader, apply func(lex *Lexicon) error,
+	current string, interval time.Duration, reload <-chan os.Signal) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-reload:
+			log.Println("Reloading lexicon")
+		}
+
+		lex, err := load()
+		if err != nil {
+			log.Printf("Unable to reload lexicon, keeping version %s\nError: %v\n", current, err)
+			continue
+		}
+		if lex.Version == current {
+			continue
+		}
+		if err := apply(lex); err != nil {
+			log.Printf("Unable to apply lexicon version %s, keeping version %s\nError: %v\n", lex.Version, current, err)
+			continue
+		}
+		log.Printf("Loaded lexicon version %s (%d terms), replacing version %s\n", lex.Version, lex.Size(), current)
+		current = lex.Version
+	}
+}
@@ -0,0 +1,153 @@
+package review
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLanguageReviewerSetLexicon(t *testing.T) {
+	r := DefaultLanguageReviewer()
+	before := r.Decide(&ProductReview{Review: "what a fee"})
+	if before.Outcome != OutcomeReject || before.Lexicon == "" {
+		t.Fatalf("Expected the built in terms to reject the review, with their version, got %+v", before)
+	}
+
+	// swap lexicons while reviews are being decided, for the race detector
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				r.Review(&ProductReview{Review: "what a fee"})
+			}
+		}()
+	}
+	lex := &Lexicon{Blacklist: []string{"dud"}, Substrings: []string{"scam"}, Allowlist: []string{"scampi"}}
+	if err := r.SetLexicon(lex); err != nil {
+		t.Fatalf("Unable to set lexicon: %v", err)
+	}
+	wg.Wait()
+
+	testcases := []struct {
+		input  string
+		passes bool
+	}{
+		{"what a fee", true},
+		{"what a DUD", false},
+		{"a scam", false},
+		{"Scampi for dinner", true},
+	}
+	for i, tc := range testcases {
+		d := r.Decide(&ProductReview{Review: tc.input})
+		if (d.Outcome == OutcomeApprove) != tc.passes {
+			t.Fatalf("Testcase %d failed: expected %t, got %+v", i, tc.passes, d)
+		}
+		if d.Lexicon == "" || d.Lexicon == before.Lexicon {
+			t.Fatalf("Testcase %d failed: expected the new lexicon's version, got %q", i, d.Lexicon)
+		}
+	}
+
+	if err := r.SetLexicon(&Lexicon{Patterns: []string{"("}}); err == nil {
+		t.Fatalf("Expected an invalid pattern to be refused")
+	}
+}
+
+func TestWatchLexicon(t *testing.T) {
+	var mu sync.Mutex
+	var versions []string
+	loads := []*Lexicon{{Version: "1"}, {Version: "1"}, {Version: "2"}}
+	load := func() (*Lexicon, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		lex := loads[0]
+		if len(loads) > 1 {
+			loads = loads[1:]
+		}
+		return lex, nil
+	}
+	apply := func(lex *Lexicon) error {
+		mu.Lock()
+		defer mu.Unlock()
+		versions = append(versions, lex.Version)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reload := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		WatchLexicon(ctx, load, apply, "0", time.Hour, reload)
+		close(done)
+	}()
+	for i := 0; i < 3; i++ {
+		reload <- syscall.SIGHUP
+	}
+	cancel()
+	<-done
+
+	if len(versions) != 2 || versions[0] != "1" || versions[1] != "2" {
+		t.Fatalf("Expected versions 1 and 2 to be applied once each, got %v", versions)
+	}
+}
+
+func TestLanguageReviewerLocales(t *testing.T) {
+	r := DefaultLanguageReviewer()
+	err := r.SetLexicon(&Lexicon{
+		Blacklist: []string{"fee"},
+		Locales: map[string]*Lexicon{
+			"fr": {Blacklist: []string{"nul"}},
+			"es": {Blacklist: []string{"basura"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to set lexicon: %v", err)
+	}
+
+	testcases := []struct {
+		review   ProductReview
+		language string
+		passes   bool
+	}{
+		{ProductReview{Review: "Ce produit est nul et je ne le recommande pas"}, "fr", false},
+		{ProductReview{Review: "This product is nul, and the fee is high"}, "en", false},
+		{ProductReview{Review: "This product is nul and it was not cheap"}, "en", true},
+		{ProductReview{Review: "Es una basura, no lo compre"}, "es", false},
+		{ProductReview{Review: "basura", Language: "es-MX"}, "es-MX", false},
+		{ProductReview{Review: "nul", Language: "en"}, "en", true},
+		{ProductReview{Review: "nul"}, "", true},
+	}
+	for i, tc := range testcases {
+		d := r.Decide(&tc.review)
+		if d.Language != tc.language || (d.Outcome == OutcomeApprove) != tc.passes {
+			t.Fatalf("Testcase %d failed: expected %t in %q, got %+v", i, tc.passes, tc.language, d)
+		}
+	}
+}
+
+func TestDefaultDetector(t *testing.T) {
+	d := DefaultDetector()
+	testcases := []struct {
+		text     string
+		language string
+	}{
+		{"This is a great bike and I love it", "en"},
+		{"Le vélo est très bien, je le recommande", "fr"},
+		{"La bicicleta es muy buena y el precio también", "es"},
+		{"دراجة رائعة", "ar"},
+		{"אופניים מצוינים", "he"},
+		{"จักรยานดีมาก", "th"},
+		{"這輛自行車很好", "zh-cht"},
+		{"Wow", ""},
+		{"la de que", ""},
+	}
+	for i, tc := range testcases {
+		if language, _ := d.Detect(tc.text); language != tc.language {
+			t.Fatalf("Testcase %d failed: expected %q, got %q", i, tc.language, language)
+		}
+	}
+}
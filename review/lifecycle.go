@@ -0,0 +1,178 @@
+package review
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Actions a ProductLifecycleReviewer can take on reviews of products that can't be sold
+const (
+	ActionReject = "reject" // reject the review
+	ActionFlag   = "flag"   // leave the review for a moderator
+	ActionIgnore = "ignore" // let the review through
+)
+
+// ProductLifecycle is when a product was, or will be, on sale
+type ProductLifecycle struct {
+	SellStartDate    time.Time
+	SellEndDate      *time.Time
+	DiscontinuedDate *time.Time
+}
+
+// ProductLookup looks up a product's lifecycle, returning nil if there's no such product
+type ProductLookup func(productID int) (*ProductLifecycle, error)
+
+// ProductLifecycleReviewer is a Reviewer that checks the reviewed product could be bought
+// when the review was written. Reviews of products not yet on sale, discontinued, or no
+// longer sold by then are rejected, flagged or let through, as set for each. Reviews of
+// unknown products are always rejected.
+//
+// Products are cached for CacheTTL once looked up, so they're not looked up for every review.
+type ProductLifecycleReviewer struct {
+	Lookup ProductLookup
+
+	NotYetOnSale string // ActionReject, ActionFlag or ActionIgnore
+	Discontinued string
+	SellEnded    string
+
+	CacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[int]cachedProduct
+}
+
+// cachedProduct is a product looked up by a ProductLifecycleReviewer, which may be nil if
+// there's no such product, and when to look it up again
+type cachedProduct struct {
+	product *ProductLifecycle
+	expires time.Time
+}
+
+// NewProductLifecycleReviewer returns a ProductLifecycleReviewer looking products up with
+// lookup. It rejects reviews of products not yet on sale or discontinued, lets reviews of
+// products that are no longer sold through, and caches products for 10 minutes.
+func NewProductLifecycleReviewer(lookup ProductLookup) *ProductLifecycleReviewer {
+	return &ProductLifecycleReviewer{
+		Lookup:       lookup,
+		NotYetOnSale: ActionReject,
+		Discontinued: ActionReject,
+		SellEnded:    ActionIgnore,
+		CacheTTL:     10 * time.Minute,
+		cache:        make(map[int]cachedProduct),
+	}
+}
+
+// ProductLifecycleFactory returns a ReviewerFactory building ProductLifecycleReviewers that
+// look products up with lookup, for registering as e.g. "productLifecycle". It takes
+// "notYetOnSale", "discontinued" and "sellEnded" options setting the action for each, and
+// "cacheSeconds", falling back to NewProductLifecycleReviewer's defaults.
+func ProductLifecycleFactory(lookup ProductLookup) ReviewerFactory {
+	return func(options json.RawMessage) (Reviewer, error) {
+		p := NewProductLifecycleReviewer(lookup)
+		opts := struct {
+			NotYetOnSale string `json:"notYetOnSale"`
+			Discontinued string `json:"discontinued"`
+			SellEnded    string `json:"sellEnded"`
+			CacheSeconds int    `json:"cacheSeconds"`
+		}{p.NotYetOnSale, p.Discontinued, p.SellEnded, int(p.CacheTTL / time.Second)}
+		if err := parseOptions(options, &opts); err != nil {
+			return nil, err
+		}
+
+		for _, action := range []string{opts.NotYetOnSale, opts.Discontinued, opts.SellEnded} {
+			if action != ActionReject && action != ActionFlag && action != ActionIgnore {
+				return nil, fmt.Errorf("Unknown action %q, expected %s, %s or %s",
+					action, ActionReject, ActionFlag, ActionIgnore)
+			}
+		}
+		if opts.CacheSeconds < 0 {
+			return nil, fmt.Errorf("cacheSeconds can't be negative")
+		}
+		p.NotYetOnSale, p.Discontinued, p.SellEnded = opts.NotYetOnSale, opts.Discontinued, opts.SellEnded
+		p.CacheTTL = time.Duration(opts.CacheSeconds) * time.Second
+		return p, nil
+	}
+}
+
+// Review approves reviews of products that could be bought when the review was written
+func (p *ProductLifecycleReviewer) Review(pr *ProductReview) (approval bool) {
+	return p.Decide(pr).Outcome == OutcomeApprove
+}
+
+// Decide checks the product could be bought when the review was written, or now if the
+// review's date isn't known. Reviews whose product can't be looked up are approved with a
+// confidence of a half, so they're left to a moderator when scored.
+func (p *ProductLifecycleReviewer) Decide(pr *ProductReview) Decision {
+	decision := Decision{Reviewer: "productLifecycle", Outcome: OutcomeApprove, Confidence: 1}
+	product, err := p.product(pr.ProductID)
+	if err != nil {
+		log.Println(err)
+		decision.Confidence = 0.5
+		decision.Reason = "Unable to look up the product"
+		return decision
+	}
+	if product == nil {
+		decision.Outcome = OutcomeReject
+		decision.Reason = fmt.Sprintf("Product %d doesn't exist", pr.ProductID)
+		return decision
+	}
+
+	reviewed := pr.ReviewDate
+	if reviewed.IsZero() {
+		reviewed = time.Now()
+	}
+	const day = "2006-01-02"
+	switch {
+	case reviewed.Before(product.SellStartDate):
+		decision.Outcome = outcomeOf(p.NotYetOnSale)
+		decision.Reason = fmt.Sprintf("Product %d isn't on sale until %s",
+			pr.ProductID, product.SellStartDate.Format(day))
+	case product.DiscontinuedDate != nil && product.DiscontinuedDate.Before(reviewed):
+		decision.Outcome = outcomeOf(p.Discontinued)
+		decision.Reason = fmt.Sprintf("Product %d was discontinued on %s",
+			pr.ProductID, product.DiscontinuedDate.Format(day))
+	case product.SellEndDate != nil && product.SellEndDate.Before(reviewed):
+		decision.Outcome = outcomeOf(p.SellEnded)
+		decision.Reason = fmt.Sprintf("Product %d stopped being sold on %s",
+			pr.ProductID, product.SellEndDate.Format(day))
+	}
+	return decision
+}
+
+// outcomeOf returns the outcome of taking the given action on a review
+func outcomeOf(action string) Outcome {
+	switch action {
+	case ActionReject:
+		return OutcomeReject
+	case ActionFlag:
+		return OutcomeManual
+	}
+	return OutcomeApprove
+}
+
+// product returns the product from the cache, looking it up if it's not there or has expired
+func (p *ProductLifecycleReviewer) product(productID int) (*ProductLifecycle, error) {
+	now := time.Now()
+	p.mu.Lock()
+	cached, ok := p.cache[productID]
+	p.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.product, nil
+	}
+
+	product, err := p.Lookup(productID)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cache == nil {
+		p.cache = make(map[int]cachedProduct)
+	}
+	p.cache[productID] = cachedProduct{product: product, expires: now.Add(p.CacheTTL)}
+	return product, nil
+}
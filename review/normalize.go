@@ -0,0 +1,115 @@
+package review
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Normalization sets which steps words go through before they're compared to a
+// blacklist, so that e.g. "FEE", "Fée", "f33" and "ｆｅｅ" all match "fee". The
+// blacklist goes through the same steps. Steps run in the order they're listed.
+type Normalization struct {
+	// NFKC replaces compatibility characters, e.g. full-width letters or ligatures,
+	// with the characters they stand for
+	NFKC bool `json:"nfkc"`
+
+	// FoldCase lower cases every letter
+	FoldCase bool `json:"foldCase"`
+
+	// StripDiacritics removes accents and other combining marks, e.g. "é" becomes "e"
+	StripDiacritics bool `json:"stripDiacritics"`
+
+	// Leetspeak replaces digits and symbols standing in for letters, using the Leetspeak table
+	Leetspeak bool `json:"leetspeak"`
+
+	// CollapseRepeats collapses runs of the same character into one, e.g. "feeee" becomes
+	// "fe". Blacklisted words are collapsed too, so "fee" still matches.
+	CollapseRepeats bool `json:"collapseRepeats"`
+
+	// JoinLetters joins runs of single letter words split by punctuation, e.g. the "f",
+	// "e" and "e" split out of "f.e.e", into one word
+	JoinLetters bool `json:"joinLetters"`
+}
+
+// DefaultNormalization returns a Normalization with every step turned on
+func DefaultNormalization() Normalization {
+	return Normalization{
+		NFKC:            true,
+		FoldCase:        true,
+		StripDiacritics: true,
+		Leetspeak:       true,
+		CollapseRepeats: true,
+		JoinLetters:     true,
+	}
+}
+
+// Leetspeak maps the digits and symbols commonly standing in for letters to the letter
+// they stand for
+var Leetspeak = map[rune]rune{
+	'0': 'o',
+	'1': 'i',
+	'3': 'e',
+	'4': 'a',
+	'5': 's',
+	'7': 't',
+	'8': 'b',
+	'@': 'a',
+	'$': 's',
+	'|': 'l',
+	'+': 't',
+}
+
+// Normalize puts the word through each normalization step that's turned on
+func (n Normalization) Normalize(word string) string {
+	if n.NFKC {
+		word = norm.NFKC.String(word)
+	}
+	if n.FoldCase {
+		word = strings.ToLower(word)
+	}
+	if n.StripDiacritics {
+		word = stripDiacritics(word)
+	}
+	if n.Leetspeak {
+		word = strings.Map(func(r rune) rune {
+			if letter, ok := Leetspeak[r]; ok {
+				return letter
+			}
+			return r
+		}, word)
+	}
+	if n.CollapseRepeats {
+		word = collapseRepeats(word)
+	}
+	return word
+}
+
+// stripDiacritics decomposes the word, drops its combining marks, and recomposes what's left
+func stripDiacritics(word string) string {
+	stripped := strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Mn, r) {
+			return -1
+		}
+		return r
+	}, norm.NFD.String(word))
+	return norm.NFC.String(stripped)
+}
+
+// collapseRepeats collapses each run of three or more of the same character in the word into two
+func collapseRepeats(word string) string {
+	var b strings.Builder
+	last, run := rune(-1), 0
+	for _, r := range word {
+		if r == last {
+			run++
+		} else {
+			last, run = r, 1
+		}
+		if run <= 2 {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
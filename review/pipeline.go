@@ -0,0 +1,277 @@
+package review
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+)
+
+// Pipeline is the chain of Reviewers a product review is vetted by, in order, and the
+// ClientNotifiers told the outcome. It's built once and shared by every job.
+type Pipeline struct {
+	Reviewers []Reviewer
+	Notifiers []ClientNotifier
+
+	// Scoring, if set, weighs up the reviewers' risk scores instead of rejecting reviews
+	// any one of them rejects. Weights holds each reviewer's weight, in the same order.
+	Scoring *Scoring
+	Weights []float64
+}
+
+// Scoring sets the thresholds a review's weighted risk score, from 0 to 1, is held to
+type Scoring struct {
+	// ApproveBelow approves reviews scoring below it
+	ApproveBelow float64 `json:"approveBelow"`
+
+	// RejectAbove rejects reviews scoring above it. Reviews scoring from ApproveBelow up
+	// to RejectAbove are left for manual moderation.
+	RejectAbove float64 `json:"rejectAbove"`
+}
+
+// Validate checks the thresholds are in range and in order
+func (s *Scoring) Validate() error {
+	if s.ApproveBelow < 0 || s.RejectAbove > 1 || s.ApproveBelow > s.RejectAbove {
+		return fmt.Errorf("Invalid scoring thresholds: expected 0 <= approveBelow (%v) <= rejectAbove (%v) <= 1",
+			s.ApproveBelow, s.RejectAbove)
+	}
+	return nil
+}
+
+// DefaultPipeline returns a pipeline vetting reviews with the default language reviewer,
+// and notifying clients with the default approval status notifier
+func DefaultPipeline() *Pipeline {
+	return &Pipeline{
+		Reviewers: []Reviewer{DefaultLanguageReviewer()},
+		Notifiers: []ClientNotifier{DefaultApprovalStatusNotifier()},
+	}
+}
+
+// Approve vets the product review with each of the pipeline's reviewers in turn, scoring
+// it if the pipeline has Scoring set
+func (p *Pipeline) Approve(r *ProductReview) *Verdict {
+	if p.Scoring != nil {
+		return r.ScoreReview(p.Scoring, p.Reviewers, p.Weights)
+	}
+	return r.ApproveReview(p.Reviewers...)
+}
+
+// SetLexicon swaps the lexicon into each of the pipeline's reviewers that uses one
+func (p *Pipeline) SetLexicon(lex *Lexicon) error {
+	for _, reviewer := range p.Reviewers {
+		if user, ok := reviewer.(LexiconUser); ok {
+			if err := user.SetLexicon(lex); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Notify tells the client the outcome of their review through each of the pipeline's notifiers
+func (p *Pipeline) Notify(r *ProductReview, approved bool, msg string) []error {
+	return r.NotifyClient(msg, approved, p.Notifiers...)
+}
+
+// PipelineConfig lists the reviewers and notifiers to build a Pipeline from, in order.
+// It's written as json, e.g.
+//
+//	{
+//	  "reviewers": [
+//	    {"type": "language", "options": {"blacklist": ["fee", "nee"]}}
+//	  ],
+//	  "notifiers": [
+//	    {"type": "approvalStatus", "options": {"sender": "Alice"}}
+//	  ]
+//	}
+//
+// Setting "scoring", e.g. {"approveBelow": 0.3, "rejectAbove": 0.7}, scores reviews
+// instead, weighing each reviewer by its "weight" (1 by default).
+type PipelineConfig struct {
+	Reviewers []StageConfig `json:"reviewers"`
+	Notifiers []StageConfig `json:"notifiers"`
+	Scoring   *Scoring      `json:"scoring,omitempty"`
+}
+
+// StageConfig configures a single reviewer or notifier in the pipeline. Options are
+// passed as they are to the factory registered for Type.
+type StageConfig struct {
+	Type     string          `json:"type"`
+	Disabled bool            `json:"disabled,omitempty"`
+	Weight   *float64        `json:"weight,omitempty"`
+	Options  json.RawMessage `json:"options,omitempty"`
+}
+
+// ReviewerFactory builds a Reviewer from its options in a PipelineConfig, which may be empty
+type ReviewerFactory func(options json.RawMessage) (Reviewer, error)
+
+// NotifierFactory builds a ClientNotifier from its options in a PipelineConfig, which may be empty
+type NotifierFactory func(options json.RawMessage) (ClientNotifier, error)
+
+// Factories maps the types named in a PipelineConfig to what builds them
+type Factories struct {
+	Reviewers map[string]ReviewerFactory
+	Notifiers map[string]NotifierFactory
+}
+
+// DefaultFactories returns factories for the reviewers and notifiers in this package:
+// the "language" reviewer and the "approvalStatus" notifier
+func DefaultFactories() *Factories {
+	return &Factories{
+		Reviewers: map[string]ReviewerFactory{
+			"language": newLanguageReviewerFromOptions,
+		},
+		Notifiers: map[string]NotifierFactory{
+			"approvalStatus": newApprovalStatusNotifierFromOptions,
+		},
+	}
+}
+
+// LoadPipelineConfig reads the pipeline config in the json file at path
+func LoadPipelineConfig(path string) (*PipelineConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read pipeline config\nError: %v", err)
+	}
+	var config PipelineConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("Unable to parse pipeline config\nError: %v", err)
+	}
+	return &config, nil
+}
+
+// Build builds the pipeline's enabled reviewers and notifiers, in the order they're
+// listed, using the given factories
+func (c *PipelineConfig) Build(factories *Factories) (*Pipeline, error) {
+	p := Pipeline{Scoring: c.Scoring}
+	if p.Scoring != nil {
+		if err := p.Scoring.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	for i, stage := range c.Reviewers {
+		if stage.Disabled {
+			continue
+		}
+		build, ok := factories.Reviewers[stage.Type]
+		if !ok {
+			return nil, fmt.Errorf("Unknown reviewer %q (reviewer %d)", stage.Type, i+1)
+		}
+		reviewer, err := build(stage.Options)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to build reviewer %q (reviewer %d)\nError: %v", stage.Type, i+1, err)
+		}
+		weight := 1.0
+		if stage.Weight != nil {
+			if weight = *stage.Weight; weight < 0 {
+				return nil, fmt.Errorf("Invalid weight %v for reviewer %q (reviewer %d)", weight, stage.Type, i+1)
+			}
+		}
+		p.Reviewers = append(p.Reviewers, reviewer)
+		p.Weights = append(p.Weights, weight)
+	}
+
+	for i, stage := range c.Notifiers {
+		if stage.Disabled {
+			continue
+		}
+		build, ok := factories.Notifiers[stage.Type]
+		if !ok {
+			return nil, fmt.Errorf("Unknown notifier %q (notifier %d)", stage.Type, i+1)
+		}
+		notifier, err := build(stage.Options)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to build notifier %q (notifier %d)\nError: %v", stage.Type, i+1, err)
+		}
+		p.Notifiers = append(p.Notifiers, notifier)
+	}
+	return &p, nil
+}
+
+// Enabled lists the types of the enabled reviewers and notifiers, in order
+func (c *PipelineConfig) Enabled() (reviewers []string, notifiers []string) {
+	for _, stage := range c.Reviewers {
+		if !stage.Disabled {
+			reviewers = append(reviewers, stage.Type)
+		}
+	}
+	for _, stage := range c.Notifiers {
+		if !stage.Disabled {
+			notifiers = append(notifiers, stage.Type)
+		}
+	}
+	return reviewers, notifiers
+}
+
+// parseOptions unmarshals a stage's options into v, leaving v as it is if there are none
+func parseOptions(options json.RawMessage, v interface{}) error {
+	if len(options) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(options, v); err != nil {
+		return fmt.Errorf("Invalid options\nError: %v", err)
+	}
+	return nil
+}
+
+// newLanguageReviewerFromOptions builds a LanguageReviewer, falling back to the default
+// blacklist, split regex, normalization steps and language detector for any option that
+// isn't set. Detection is turned off with "detect": false.
+func newLanguageReviewerFromOptions(options json.RawMessage) (Reviewer, error) {
+	opts := struct {
+		Blacklist     []string      `json:"blacklist"`
+		Allowlist     []string      `json:"allowlist"`
+		Substrings    []string      `json:"substrings"`
+		Patterns      []string      `json:"patterns"`
+		Wildcards     []string      `json:"wildcards"`
+		SplitRegex    string        `json:"splitRegex"`
+		Normalization Normalization `json:"normalization"`
+		Detect        bool          `json:"detect"`
+	}{Normalization: DefaultNormalization(), Detect: true}
+	if err := parseOptions(options, &opts); err != nil {
+		return nil, err
+	}
+
+	reviewer := DefaultLanguageReviewer()
+	l := LanguageReviewer{
+		Blacklist:     reviewer.Blacklist,
+		Allowlist:     opts.Allowlist,
+		Substrings:    opts.Substrings,
+		SplitRegex:    reviewer.SplitRegex,
+		Normalization: opts.Normalization,
+	}
+	if opts.Detect {
+		l.Detector = reviewer.Detector
+	}
+	if opts.Blacklist != nil {
+		l.Blacklist = opts.Blacklist
+	}
+	if opts.SplitRegex != "" {
+		r, err := regexp.Compile(opts.SplitRegex)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid splitRegex\nError: %v", err)
+		}
+		l.SplitRegex = r
+	}
+	for _, pattern := range opts.Patterns {
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern %q\nError: %v", pattern, err)
+		}
+		l.Patterns = append(l.Patterns, r)
+	}
+	for _, glob := range opts.Wildcards {
+		l.Patterns = append(l.Patterns, l.WildcardPattern(glob))
+	}
+	return &l, nil
+}
+
+// newApprovalStatusNotifierFromOptions builds an ApprovalStatusNotifier, sending as the
+// default sender unless one is set
+func newApprovalStatusNotifierFromOptions(options json.RawMessage) (ClientNotifier, error) {
+	notifier := DefaultApprovalStatusNotifier()
+	if err := parseOptions(options, notifier); err != nil {
+		return nil, err
+	}
+	return notifier, nil
+}
@@ -0,0 +1,217 @@
+package review
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPipelineConfigBuild(t *testing.T) {
+	var config PipelineConfig
+	err := json.Unmarshal([]byte(`{
+		"reviewers": [
+			{"type": "language", "disabled": true},
+			{"type": "language", "options": {"blacklist": ["dud"]}}
+		],
+		"notifiers": [{"type": "approvalStatus", "options": {"sender": "Alice"}}]
+	}`), &config)
+	if err != nil {
+		t.Fatalf("Unable to parse config: %v", err)
+	}
+
+	p, err := config.Build(DefaultFactories())
+	if err != nil {
+		t.Fatalf("Unable to build pipeline: %v", err)
+	}
+	if len(p.Reviewers) != 1 || len(p.Notifiers) != 1 {
+		t.Fatalf("Expected 1 enabled reviewer and notifier, got %d and %d", len(p.Reviewers), len(p.Notifiers))
+	}
+	if sender := p.Notifiers[0].(*ApprovalStatusNotifier).Sender; sender != "Alice" {
+		t.Fatalf("Expected the notifier to send as Alice, got %s", sender)
+	}
+	if p.Approve(&ProductReview{Review: "what a dud"}).Approved {
+		t.Fatalf("Expected the configured blacklist to deny the review")
+	}
+	if !p.Approve(&ProductReview{Review: "stick it in your leent"}).Approved {
+		t.Fatalf("Expected the default blacklist to be replaced")
+	}
+
+	config.Reviewers = append(config.Reviewers, StageConfig{Type: "sentiment"})
+	if _, err := config.Build(DefaultFactories()); err == nil {
+		t.Fatalf("Expected an unknown reviewer to fail the build")
+	}
+}
+
+func TestPipelineLanguageDetection(t *testing.T) {
+	lex := &Lexicon{Locales: map[string]*Lexicon{"fr": {Blacklist: []string{"nul"}}}}
+	review := &ProductReview{Review: "Ce produit est nul et je ne le recommande pas"}
+
+	for _, tc := range []struct {
+		options string
+		passes  bool
+	}{
+		{`{}`, false},
+		{`{"detect": false}`, true},
+	} {
+		var config PipelineConfig
+		config.Reviewers = []StageConfig{{Type: "language", Options: json.RawMessage(tc.options)}}
+		p, err := config.Build(DefaultFactories())
+		if err != nil {
+			t.Fatalf("Unable to build pipeline: %v", err)
+		}
+		if err := p.SetLexicon(lex); err != nil {
+			t.Fatalf("Unable to set lexicon: %v", err)
+		}
+		if approved := p.Approve(review).Approved; approved != tc.passes {
+			t.Fatalf("Expected %t for a french review without a declared language with %s, got %t",
+				tc.passes, tc.options, approved)
+		}
+	}
+}
+
+// riskyReviewer rejects every review with the given confidence
+type riskyReviewer float64
+
+func (r riskyReviewer) Review(pr *ProductReview) bool { return false }
+
+func (r riskyReviewer) Decide(pr *ProductReview) Decision {
+	return Decision{Reviewer: "risky", Outcome: OutcomeReject, Confidence: float64(r)}
+}
+
+func TestPipelineScoring(t *testing.T) {
+	scoring := &Scoring{ApproveBelow: 0.3, RejectAbove: 0.7}
+	testcases := []struct {
+		reviewers []Reviewer
+		weights   []float64
+		score     float64
+		outcome   Outcome
+	}{
+		{[]Reviewer{DefaultLanguageReviewer(), riskyReviewer(0.2)}, []float64{1, 1}, 0.1, OutcomeApprove},
+		{[]Reviewer{DefaultLanguageReviewer(), riskyReviewer(0.8)}, []float64{1, 1}, 0.4, OutcomeManual},
+		{[]Reviewer{DefaultLanguageReviewer(), riskyReviewer(0.8)}, []float64{1, 9}, 0.72, OutcomeReject},
+		{[]Reviewer{riskyReviewer(0.9)}, nil, 0.9, OutcomeReject},
+	}
+
+	for i, tc := range testcases {
+		p := &Pipeline{Reviewers: tc.reviewers, Weights: tc.weights, Scoring: scoring}
+		verdict := p.Approve(&ProductReview{Review: "a fine product"})
+		if diff := verdict.Score - tc.score; diff > 1e-9 || diff < -1e-9 {
+			t.Fatalf("Testcase %d failed: expected score %v, got %v", i, tc.score, verdict.Score)
+		}
+		if verdict.Outcome != tc.outcome || verdict.Approved != (tc.outcome == OutcomeApprove) {
+			t.Fatalf("Testcase %d failed: expected %s, got %+v", i, tc.outcome, verdict)
+		}
+		if len(verdict.Decisions) != len(tc.reviewers) {
+			t.Fatalf("Testcase %d failed: expected every reviewer's decision to be kept, got %v", i, verdict.Decisions)
+		}
+	}
+
+	if err := (&Scoring{ApproveBelow: 0.8, RejectAbove: 0.2}).Validate(); err == nil {
+		t.Fatalf("Expected thresholds out of order to be invalid")
+	}
+}
+
+// fakeVerifier knows of purchases by email address, failing for any other address
+type fakeVerifier map[string]bool
+
+func (f fakeVerifier) HasPurchased(email string, productID int) (bool, error) {
+	purchased, ok := f[email]
+	if !ok {
+		return false, fmt.Errorf("unknown customer %s", email)
+	}
+	return purchased, nil
+}
+
+func TestVerifiedPurchaseReviewer(t *testing.T) {
+	factories := DefaultFactories()
+	factories.Reviewers["verifiedPurchase"] = VerifiedPurchaseFactory(fakeVerifier{
+		"buyer@foo.com":   true,
+		"browser@foo.com": false,
+	})
+
+	for _, required := range []bool{true, false} {
+		config := PipelineConfig{Reviewers: []StageConfig{{
+			Type:    "verifiedPurchase",
+			Options: json.RawMessage(fmt.Sprintf(`{"required": %t}`, required)),
+		}}}
+		p, err := config.Build(factories)
+		if err != nil {
+			t.Fatalf("Unable to build pipeline: %v", err)
+		}
+
+		testcases := []struct {
+			email    string
+			approved bool
+			verified *bool
+		}{
+			{"buyer@foo.com", true, &[]bool{true}[0]},
+			{"browser@foo.com", !required, &[]bool{false}[0]},
+			{"stranger@foo.com", true, nil},
+		}
+		for i, tc := range testcases {
+			verdict := p.Approve(&ProductReview{EmailAddress: tc.email, ProductID: 707})
+			verified := verdict.VerifiedPurchase()
+			if verdict.Approved != tc.approved || (verified == nil) != (tc.verified == nil) ||
+				(verified != nil && *verified != *tc.verified) {
+				t.Fatalf("Testcase %d failed with required %t: expected %t and %v, got %+v",
+					i, required, tc.approved, tc.verified, verdict)
+			}
+		}
+	}
+}
+
+func TestProductLifecycleReviewer(t *testing.T) {
+	day := func(s string) *time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return &d
+	}
+	products := map[int]*ProductLifecycle{
+		1: {SellStartDate: *day("2011-05-31")},
+		2: {SellStartDate: *day("2030-01-01")},
+		3: {SellStartDate: *day("2011-05-31"), DiscontinuedDate: day("2013-05-29")},
+		4: {SellStartDate: *day("2011-05-31"), SellEndDate: day("2013-05-29")},
+	}
+	lookups := 0
+	factories := DefaultFactories()
+	factories.Reviewers["productLifecycle"] = ProductLifecycleFactory(func(productID int) (*ProductLifecycle, error) {
+		lookups++
+		return products[productID], nil
+	})
+
+	config := PipelineConfig{Reviewers: []StageConfig{{
+		Type:    "productLifecycle",
+		Options: json.RawMessage(`{"notYetOnSale": "flag", "sellEnded": "reject"}`),
+	}}}
+	p, err := config.Build(factories)
+	if err != nil {
+		t.Fatalf("Unable to build pipeline: %v", err)
+	}
+
+	testcases := []struct {
+		productID int
+		date      time.Time
+		outcome   Outcome
+	}{
+		{1, time.Time{}, OutcomeApprove},
+		{2, time.Time{}, OutcomeManual},
+		{3, *day("2013-05-30"), OutcomeReject},
+		{3, *day("2012-01-01"), OutcomeApprove},
+		{4, *day("2014-01-01"), OutcomeReject},
+		{5, time.Time{}, OutcomeReject},
+	}
+	for i, tc := range testcases {
+		verdict := p.Approve(&ProductReview{ProductID: tc.productID, ReviewDate: tc.date})
+		if verdict.Outcome != tc.outcome {
+			t.Fatalf("Testcase %d failed: expected %s, got %+v", i, tc.outcome, verdict)
+		}
+	}
+	if lookups != 5 {
+		t.Fatalf("Expected each product to be looked up once, got %d lookups", lookups)
+	}
+
+	config.Reviewers[0].Options = json.RawMessage(`{"discontinued": "delete"}`)
+	if _, err := config.Build(factories); err == nil {
+		t.Fatalf("Expected an unknown action to fail")
+	}
+}
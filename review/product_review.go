@@ -6,8 +6,12 @@ import (
 	"html/template"
 	"regexp"
 	"strings"
+	"time"
 )
 
+// languageRegex matches culture ids, e.g. "en", "fr-CA" or "zh-cht"
+var languageRegex = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z]{2,4})?$`)
+
 // ProductReview represents a client's product review
 type ProductReview struct {
 	ProductID    int    `json:"productid"`
@@ -15,6 +19,14 @@ type ProductReview struct {
 	ReviewerName string `json:"name"`
 	EmailAddress string `json:"email"`
 	Rating       int    `json:"rating"`
+
+	// Language is the culture id of the language the review is written in, e.g. "fr" or
+	// "zh-cht", if the client declared it. It's detected when it's needed otherwise.
+	Language string `json:"language,omitempty"`
+
+	// ReviewDate is when the review was received, set by the server rather than the client.
+	// It's zero for reviews queued before it was recorded.
+	ReviewDate time.Time `json:"reviewDate"`
 }
 
 // Sanitize escapes html and javascript in the review, to help prevent XSS attacks
@@ -34,14 +46,63 @@ func (r *ProductReview) NotifyClient(msg string, approved bool, notifiers ...Cli
 	return errors
 }
 
-// ApproveReview vets the product review for approval using the passed in Reviewers
-func (r *ProductReview) ApproveReview(reviewers ...Reviewer) bool {
+// ApproveReview vets the product review for approval using the passed in Reviewers,
+// combining their decisions. Every reviewer has its say, so the verdict explains each
+// reason the review was rejected; it's approved only if none of them rejected it, and left
+// to a moderator if any flagged it instead.
+func (r *ProductReview) ApproveReview(reviewers ...Reviewer) *Verdict {
+	verdict := Verdict{Approved: true, Outcome: OutcomeApprove}
 	for _, reviewer := range reviewers {
-		if reviewer.Review(r) == false {
-			return false
+		decision := decide(reviewer, r)
+		switch {
+		case decision.Outcome == OutcomeReject:
+			if verdict.Outcome != OutcomeReject {
+				verdict.Reason = decision.Reason
+			}
+			verdict.Approved, verdict.Outcome = false, OutcomeReject
+		case decision.Outcome == OutcomeManual && verdict.Outcome == OutcomeApprove:
+			verdict.Approved, verdict.Outcome = false, OutcomeManual
+			verdict.Reason = decision.Reason
 		}
+		verdict.Decisions = append(verdict.Decisions, decision)
 	}
-	return true
+	return &verdict
+}
+
+// ScoreReview vets the product review using the passed in Reviewers, averaging the risk
+// each one sees in it by the matching weight. Reviewers without a weight weigh 1. The
+// review is approved if the score falls below the scoring's ApproveBelow threshold,
+// rejected if it rises above RejectAbove, and left to a moderator in between.
+func (r *ProductReview) ScoreReview(scoring *Scoring, reviewers []Reviewer, weights []float64) *Verdict {
+	var verdict Verdict
+	var total, weighed float64
+	for i, reviewer := range reviewers {
+		decision := decide(reviewer, r)
+		decision.Weight = 1
+		if i < len(weights) {
+			decision.Weight = weights[i]
+		}
+		total += decision.Weight * decision.Risk
+		weighed += decision.Weight
+		verdict.Decisions = append(verdict.Decisions, decision)
+	}
+	if weighed > 0 {
+		verdict.Score = total / weighed
+	}
+
+	switch {
+	case verdict.Score < scoring.ApproveBelow:
+		verdict.Approved, verdict.Outcome = true, OutcomeApprove
+		verdict.Reason = fmt.Sprintf("Risk score %.2f is below %.2f", verdict.Score, scoring.ApproveBelow)
+	case verdict.Score > scoring.RejectAbove:
+		verdict.Outcome = OutcomeReject
+		verdict.Reason = fmt.Sprintf("Risk score %.2f is above %.2f", verdict.Score, scoring.RejectAbove)
+	default:
+		verdict.Outcome = OutcomeManual
+		verdict.Reason = fmt.Sprintf("Risk score %.2f is between %.2f and %.2f",
+			verdict.Score, scoring.ApproveBelow, scoring.RejectAbove)
+	}
+	return &verdict
 }
 
 // Validate ensures all the input values in the review are valid
@@ -88,6 +149,12 @@ func (r *ProductReview) Validate() (errors []error) {
 		}
 	}
 
+	// validate language, if any
+	if r.Language != "" && !languageRegex.MatchString(r.Language) {
+		err := fmt.Errorf("Invalid language: please use a culture id such as en or zh-cht")
+		errors = append(errors, err)
+	}
+
 	// validate rating
 	if r.Rating != 0 && (r.Rating > 5 || r.Rating < 1) {
 		err := fmt.Errorf("Rating must be a value in the range of 1 to 5")
@@ -0,0 +1,67 @@
+package review
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// PurchaseVerifier looks up whether the customer with an email address ever ordered a product
+type PurchaseVerifier interface {
+	HasPurchased(email string, productID int) (bool, error)
+}
+
+// VerifiedPurchaseReviewer is a Reviewer that checks the reviewer bought the product they
+// review, with the email address they review with. It only rejects reviews from people who
+// didn't when Required is set. Either way, its decision records what it found.
+type VerifiedPurchaseReviewer struct {
+	Verifier PurchaseVerifier
+	Required bool
+}
+
+// NewVerifiedPurchaseReviewer returns a VerifiedPurchaseReviewer looking purchases up with verifier
+func NewVerifiedPurchaseReviewer(verifier PurchaseVerifier, required bool) *VerifiedPurchaseReviewer {
+	return &VerifiedPurchaseReviewer{Verifier: verifier, Required: required}
+}
+
+// VerifiedPurchaseFactory returns a ReviewerFactory building VerifiedPurchaseReviewers that look
+// purchases up with verifier, for registering as e.g. "verifiedPurchase". It takes a "required"
+// option, false by default.
+func VerifiedPurchaseFactory(verifier PurchaseVerifier) ReviewerFactory {
+	return func(options json.RawMessage) (Reviewer, error) {
+		var opts struct {
+			Required bool `json:"required"`
+		}
+		if err := parseOptions(options, &opts); err != nil {
+			return nil, err
+		}
+		return NewVerifiedPurchaseReviewer(verifier, opts.Required), nil
+	}
+}
+
+// Review approves reviews by people who bought the product, and everyone else's too unless
+// a purchase is Required
+func (v *VerifiedPurchaseReviewer) Review(pr *ProductReview) (approval bool) {
+	return v.Decide(pr).Outcome == OutcomeApprove
+}
+
+// Decide checks the reviewer bought the product. Reviews whose purchase can't be looked up
+// are approved with a confidence of a half, so they're left to a moderator when scored.
+func (v *VerifiedPurchaseReviewer) Decide(pr *ProductReview) Decision {
+	decision := Decision{Reviewer: "verifiedPurchase", Outcome: OutcomeApprove, Confidence: 1}
+	verified, err := v.Verifier.HasPurchased(pr.EmailAddress, pr.ProductID)
+	if err != nil {
+		log.Println(err)
+		decision.Confidence = 0.5
+		decision.Reason = "Unable to verify the purchase"
+		return decision
+	}
+
+	decision.VerifiedPurchase = &verified
+	if !verified {
+		decision.Reason = "No order of the product was found for the reviewer's email address"
+		if v.Required {
+			decision.Outcome = OutcomeReject
+		}
+	}
+	return decision
+}
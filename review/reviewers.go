@@ -1,30 +1,89 @@
 package review
 
 import (
-	"log"
+	"fmt"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
 )
 
-// Singleton to hold default language reviewer
-var defaultLangReviewerSingleton *LanguageReviewer
+// defaultSplitRegex splits reviews into words at punctuation and whitespace. It's compiled
+// once, and shared by every default language reviewer.
+var defaultSplitRegex = regexp.MustCompile(`[.,\/#!$%\^&\*;:{}=\-_\x60~()\s]`)
 
 // Reviewer reviews the given ProductReview based on some criteria
 type Reviewer interface {
 	Review(pr *ProductReview) (approval bool)
 }
 
-// LanguageReviewer is a Reviewer that checks for blacklisted words
+// LanguageReviewer is a Reviewer that checks for blacklisted words and phrases, and text
+// matching substring and pattern rules. Words are compared to the blacklist after both go
+// through Normalization, so it matches exactly by default.
+//
+// The terms are compiled into a lexicon the first time the reviewer is used, building the
+// blacklist and substrings into an Aho-Corasick automaton, so reviews are searched for every
+// term at once, however many there are. They, and the normalization, mustn't change after
+// that; SetLexicon swaps in new terms safely while the reviewer's in use.
 type LanguageReviewer struct {
-	Blacklist  []string
-	SplitRegex *regexp.Regexp
+	// Blacklist lists words, and phrases of several words, matched as whole words
+	Blacklist []string
+
+	// Allowlist lists words and phrases that are never matched, e.g. "scampi" when "scam"
+	// is a substring
+	Allowlist []string
+
+	// Substrings lists terms matched anywhere, even within a word
+	Substrings []string
+
+	// Patterns are matched against the review once its words are normalized and joined
+	// by single spaces, with a space before the first word and after the last.
+	// WildcardPattern builds ones matching whole words.
+	Patterns []*regexp.Regexp
+
+	SplitRegex    *regexp.Regexp
+	Normalization Normalization
+
+	// Detector guesses the language of reviews that don't declare one, when the lexicon
+	// has terms for particular languages. Reviews in a language it has no terms for are
+	// only checked for the terms shared by every language.
+	Detector Detector
+
+	mu      sync.RWMutex
+	lexicon *compiledLexicon
+}
+
+// compiledLexicon is the set of terms a LanguageReviewer is looking for, ready to match
+type compiledLexicon struct {
+	version  string
+	matcher  *ahoCorasick
+	keywords []string // the blacklist entry or substring each of matcher's keywords stands for
+	patterns []*regexp.Regexp
+	allowed  map[string]bool // normalized words and phrases
+
+	// locales holds the terms for reviews in each language, the shared ones included
+	locales map[string]*compiledLexicon
+}
+
+// forLanguage returns the terms to look for in reviews in the given language, falling
+// back from e.g. "fr-ca" to "fr", and then to the terms shared by every language
+func (c *compiledLexicon) forLanguage(language string) *compiledLexicon {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if locale, ok := c.locales[language]; ok {
+		return locale
+	}
+	if i := strings.Index(language, "-"); i > 0 {
+		if locale, ok := c.locales[language[:i]]; ok {
+			return locale
+		}
+	}
+	return c
 }
 
 // NewLanguageReviewer returns a LanguageReviewer for use
 func NewLanguageReviewer(blacklist []string, r *regexp.Regexp) *LanguageReviewer {
-	// avoid costly regex compilation at scale by package-local singleton
-	if defaultLangReviewerSingleton != nil {
-		return defaultLangReviewerSingleton
-	}
 	return &LanguageReviewer{
 		Blacklist:  blacklist,
 		SplitRegex: r,
@@ -32,23 +91,285 @@ func NewLanguageReviewer(blacklist []string, r *regexp.Regexp) *LanguageReviewer
 }
 
 // DefaultLanguageReviewer returns a default LanguageReviewer using sensible defaults
-// for the blacklist of words and an effective regex to remove punctuation characters
+// for the blacklist of words and an effective regex to remove punctuation characters,
+// with every normalization step turned on
 func DefaultLanguageReviewer() *LanguageReviewer {
 	blacklist := []string{"fee", "nee", "cruul", "leent"}
-	r := regexp.MustCompile(`[.,\/#!$%\^&\*;:{}=\-_\x60~()\s]`)
-	return NewLanguageReviewer(blacklist, r)
+	l := NewLanguageReviewer(blacklist, defaultSplitRegex)
+	l.Normalization = DefaultNormalization()
+	l.Detector = DefaultDetector()
+	return l
 }
 
 // Review ensures there is no blacklisted words present in the review's comment
 func (l *LanguageReviewer) Review(pr *ProductReview) (approval bool) {
-	for _, word := range l.SplitRegex.Split(pr.Review, -1) {
-		for _, term := range l.Blacklist {
-			if word == term {
-				log.Printf("Review by %s denied approval due to usage"+
-					" of blacklisted term\n", pr.EmailAddress)
-				return false
+	return l.Decide(pr).Outcome == OutcomeApprove
+}
+
+// Decide rejects reviews whose comment uses any blacklisted words or phrases, or matches
+// any substring or pattern, giving each match as evidence
+func (l *LanguageReviewer) Decide(pr *ProductReview) Decision {
+	lexicon := l.currentLexicon()
+	language := pr.Language
+	if language == "" && l.Detector != nil && len(lexicon.locales) > 0 {
+		language, _ = l.Detector.Detect(pr.Review)
+	}
+	lexicon = lexicon.forLanguage(language)
+	decision := Decision{Reviewer: "language", Outcome: OutcomeApprove, Confidence: 1,
+		Lexicon: lexicon.version, Language: language}
+
+	// normalize the review's words and join them into one text to search, remembering
+	// where each one came from
+	text := pr.Review
+	var b strings.Builder
+	var spans []span
+	b.WriteByte(' ')
+	for _, w := range l.words(text) {
+		normalized := l.Normalization.Normalize(w.text)
+		if normalized == "" {
+			continue
+		}
+		spans = append(spans, span{b.Len(), b.Len() + len(normalized), w})
+		b.WriteString(normalized)
+		b.WriteByte(' ')
+	}
+	normalized := b.String()
+
+	found := make(map[Evidence]bool)
+	addEvidence := func(start, end int, term string) {
+		// the words the match overlaps
+		first := sort.Search(len(spans), func(i int) bool { return spans[i].end > start })
+		last := sort.Search(len(spans), func(i int) bool { return spans[i].start >= end }) - 1
+		if first > last || lexicon.allowed[normalized[spans[first].start:spans[last].end]] {
+			return
+		}
+		from, to := spans[first].word.start, spans[last].word.end
+		e := Evidence{Term: text[from:to], Position: utf8.RuneCountInString(text[:from])}
+		if e.Term != term {
+			e.Detail = "matches " + term
+		}
+		if !found[e] {
+			found[e] = true
+			decision.Evidence = append(decision.Evidence, e)
+		}
+	}
+
+	for _, m := range lexicon.matcher.find(normalized) {
+		addEvidence(m.start, m.end, lexicon.keywords[m.keyword])
+	}
+	for _, pattern := range lexicon.patterns {
+		// patterns usually match the spaces around a word, so carry on from the last byte of
+		// each match to find words right next to each other
+		for pos := 0; pos < len(normalized); {
+			loc := pattern.FindStringIndex(normalized[pos:])
+			if loc == nil {
+				break
+			}
+			addEvidence(pos+loc[0], pos+loc[1], strings.TrimSpace(pattern.String()))
+			if loc[1]-1 > loc[0] {
+				pos += loc[1] - 1
+			} else {
+				pos += loc[0] + 1
+			}
+		}
+	}
+	sort.SliceStable(decision.Evidence, func(i, j int) bool {
+		return decision.Evidence[i].Position < decision.Evidence[j].Position
+	})
+
+	if len(decision.Evidence) > 0 {
+		decision.Outcome = OutcomeReject
+		decision.Reason = "Uses language against our community guidelines"
+	}
+	return decision
+}
+
+// SetLexicon replaces the terms the reviewer looks for with the lexicon's. It's safe to
+// call while the reviewer's in use: reviews already being decided finish with the old terms.
+func (l *LanguageReviewer) SetLexicon(lex *Lexicon) error {
+	version := lex.Version
+	if version == "" {
+		versioned := *lex
+		versioned.SetVersion()
+		version = versioned.Version
+	}
+
+	compiled, err := l.compileLexicon(lex, version)
+	if err != nil {
+		return err
+	}
+	compiled.locales = make(map[string]*compiledLexicon, len(lex.Locales))
+	for language, locale := range lex.Locales {
+		if locale == nil {
+			continue
+		}
+		merged := Lexicon{
+			Blacklist:  concat(lex.Blacklist, locale.Blacklist),
+			Allowlist:  concat(lex.Allowlist, locale.Allowlist),
+			Substrings: concat(lex.Substrings, locale.Substrings),
+			Wildcards:  concat(lex.Wildcards, locale.Wildcards),
+			Patterns:   concat(lex.Patterns, locale.Patterns),
+		}
+		if compiled.locales[strings.ToLower(language)], err = l.compileLexicon(&merged, version); err != nil {
+			return fmt.Errorf("Invalid %s lexicon\nError: %v", language, err)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lexicon = compiled
+	return nil
+}
+
+// compileLexicon compiles the lexicon's terms, leaving out its locales
+func (l *LanguageReviewer) compileLexicon(lex *Lexicon, version string) (*compiledLexicon, error) {
+	patterns := make([]*regexp.Regexp, 0, len(lex.Patterns)+len(lex.Wildcards))
+	for _, pattern := range lex.Patterns {
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern %q\nError: %v", pattern, err)
+		}
+		patterns = append(patterns, r)
+	}
+	for _, glob := range lex.Wildcards {
+		patterns = append(patterns, l.WildcardPattern(glob))
+	}
+	return l.compile(version, lex.Blacklist, lex.Allowlist, lex.Substrings, patterns), nil
+}
+
+// concat returns a new slice holding the terms of a followed by those of b
+func concat(a, b []string) []string {
+	return append(append(make([]string, 0, len(a)+len(b)), a...), b...)
+}
+
+// currentLexicon returns the lexicon in use, compiling the reviewer's own terms into it on
+// first use if SetLexicon hasn't been called
+func (l *LanguageReviewer) currentLexicon() *compiledLexicon {
+	l.mu.RLock()
+	lexicon := l.lexicon
+	l.mu.RUnlock()
+	if lexicon != nil {
+		return lexicon
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.lexicon == nil {
+		lex := Lexicon{Blacklist: l.Blacklist, Allowlist: l.Allowlist, Substrings: l.Substrings}
+		for _, pattern := range l.Patterns {
+			lex.Patterns = append(lex.Patterns, pattern.String())
+		}
+		lex.SetVersion()
+		l.lexicon = l.compile(lex.Version, l.Blacklist, l.Allowlist, l.Substrings, l.Patterns)
+	}
+	return l.lexicon
+}
+
+// compile builds the automaton matching the normalized blacklist and substrings. Blacklist
+// entries are padded with spaces, so they only match whole words in the normalized review.
+func (l *LanguageReviewer) compile(version string, blacklist, allowlist, substrings []string,
+	patterns []*regexp.Regexp) *compiledLexicon {
+	lexicon := compiledLexicon{version: version, patterns: patterns, allowed: make(map[string]bool)}
+	var keys []string
+	for _, term := range blacklist {
+		if phrase := l.normalizePhrase(term); phrase != "" {
+			keys = append(keys, " "+phrase+" ")
+			lexicon.keywords = append(lexicon.keywords, term)
+		}
+	}
+	for _, term := range substrings {
+		if normalized := l.Normalization.Normalize(term); normalized != "" {
+			keys = append(keys, normalized)
+			lexicon.keywords = append(lexicon.keywords, term)
+		}
+	}
+	for _, term := range allowlist {
+		lexicon.allowed[l.normalizePhrase(term)] = true
+	}
+	lexicon.matcher = newAhoCorasick(keys)
+	return &lexicon
+}
+
+// normalizePhrase normalizes each word in the phrase, joining them by single spaces as
+// they are in the normalized review
+func (l *LanguageReviewer) normalizePhrase(phrase string) string {
+	var words []string
+	for _, w := range l.words(phrase) {
+		if normalized := l.Normalization.Normalize(w.text); normalized != "" {
+			words = append(words, normalized)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// WildcardPattern returns a pattern matching whole words like the glob, where * stands for
+// any run of characters within a word and ? for any one character. The glob is normalized
+// as words are.
+func (l *LanguageReviewer) WildcardPattern(glob string) *regexp.Regexp {
+	var expr strings.Builder
+	expr.WriteString(" ")
+	for _, r := range l.Normalization.Normalize(glob) {
+		switch r {
+		case '*':
+			expr.WriteString("[^ ]*")
+		case '?':
+			expr.WriteString("[^ ]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString(" ")
+	return regexp.MustCompile(expr.String())
+}
+
+// span is where a word of the review lies in the normalized text searched, in bytes
+type span struct {
+	start, end int
+	word       word
+}
+
+// word is a word in the text being reviewed, and where it lies in it, in bytes
+type word struct {
+	text       string
+	start, end int
+}
+
+// words splits the text into words at the matches of the split regex. With JoinLetters
+// on, each run of single letter words split by anything but whitespace becomes one word,
+// spanning the separators in between, so "f.e.e" is one word but "a fee" still two.
+func (l *LanguageReviewer) words(text string) []word {
+	var words []word
+	seps := append(l.SplitRegex.FindAllStringIndex(text, -1), []int{len(text), len(text)})
+	start := 0
+	for _, sep := range seps {
+		if sep[0] > start {
+			words = append(words, word{text[start:sep[0]], start, sep[0]})
+		}
+		start = sep[1]
+	}
+	if !l.Normalization.JoinLetters {
+		return words
+	}
+
+	var joined []word
+	for i := 0; i < len(words); i++ {
+		j := i
+		for j < len(words) && utf8.RuneCountInString(words[j].text) == 1 {
+			j++
+			if j < len(words) && strings.IndexFunc(text[words[j-1].end:words[j].start], unicode.IsSpace) >= 0 {
+				break
+			}
+		}
+		if j-i > 1 {
+			w := word{start: words[i].start, end: words[j-1].end}
+			for _, letter := range words[i:j] {
+				w.text += letter.text
 			}
+			joined = append(joined, w)
+			i = j - 1
+		} else {
+			joined = append(joined, words[i])
 		}
 	}
-	return true
+	return joined
 }
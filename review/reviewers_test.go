@@ -1,6 +1,11 @@
 package review
 
-import "testing"
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
 
 func TestDefaultLanguageReviewer(t *testing.T) {
 	r := DefaultLanguageReviewer()
@@ -34,3 +39,141 @@ func TestDefaultLanguageReviewer(t *testing.T) {
 		}
 	}
 }
+
+// BenchmarkLanguageReviewer reviews a long review against a blacklist of thousands of terms
+func BenchmarkLanguageReviewer(b *testing.B) {
+	r := DefaultLanguageReviewer()
+	for i := 0; i < 5000; i++ {
+		r.Blacklist = append(r.Blacklist, fmt.Sprintf("term%dx", i), fmt.Sprintf("some phrase %dx", i))
+	}
+	review := &ProductReview{Review: strings.Repeat("This ball bearing is sturdy, smooth and well priced. ", 70)}
+	r.Review(review) // build the automaton up front
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Review(review)
+	}
+}
+
+func TestLanguageReviewerRules(t *testing.T) {
+	r := DefaultLanguageReviewer()
+	r.Blacklist = append(r.Blacklist, "rip off")
+	r.Substrings = []string{"scam"}
+	r.Patterns = []*regexp.Regexp{regexp.MustCompile(` buy (it )?now `), r.WildcardPattern("cr*l")}
+
+	testcases := []struct {
+		input    string
+		evidence []Evidence
+	}{
+		{"what a RIP-OFF", []Evidence{{Term: "RIP-OFF", Position: 7, Detail: "matches rip off"}}},
+		{"what a rip or off", nil},
+		{"a tripoff", nil},
+		{"scammers!", []Evidence{{Term: "scammers", Position: 0, Detail: "matches scam"}}},
+		{"Buy it NOW!", []Evidence{{Term: "Buy it NOW", Position: 0, Detail: "matches buy (it )?now"}}},
+		{"cruel crawl cruel", []Evidence{
+			{Term: "cruel", Position: 0, Detail: "matches cr[^ ]*l"},
+			{Term: "crawl", Position: 6, Detail: "matches cr[^ ]*l"},
+			{Term: "cruel", Position: 12, Detail: "matches cr[^ ]*l"},
+		}},
+		{"fee fee", []Evidence{{Term: "fee", Position: 0}, {Term: "fee", Position: 4}}},
+	}
+
+	for i, tc := range testcases {
+		d := r.Decide(&ProductReview{Review: tc.input})
+		if len(d.Evidence) != len(tc.evidence) {
+			t.Fatalf("Testcase %d failed: expected evidence %v, got %v", i, tc.evidence, d.Evidence)
+		}
+		for j, e := range tc.evidence {
+			if d.Evidence[j] != e {
+				t.Fatalf("Testcase %d failed: expected evidence %v, got %v", i, e, d.Evidence[j])
+			}
+		}
+	}
+}
+
+func TestLanguageReviewerDecide(t *testing.T) {
+	r := DefaultLanguageReviewer()
+	d := r.Decide(&ProductReview{Review: "Ça marche, but it's a leent. A total fee!"})
+	if d.Outcome != OutcomeReject || d.Reviewer != "language" {
+		t.Fatalf("Expected the language reviewer to reject the review, got %+v", d)
+	}
+	expected := []Evidence{{Term: "leent", Position: 22}, {Term: "fee", Position: 37}}
+	if len(d.Evidence) != len(expected) {
+		t.Fatalf("Expected evidence %v, got %v", expected, d.Evidence)
+	}
+	for i, e := range expected {
+		if d.Evidence[i] != e {
+			t.Fatalf("Expected evidence %v, got %v", e, d.Evidence[i])
+		}
+	}
+}
+
+func TestNormalization(t *testing.T) {
+	testcases := []struct {
+		step     Normalization
+		input    string
+		expected string
+	}{
+		{Normalization{}, "Ｆée", "Ｆée"},
+		{Normalization{NFKC: true}, "ｆｅｅ", "fee"},
+		{Normalization{NFKC: true}, "ﬁne", "fine"},
+		{Normalization{FoldCase: true}, "FeE", "fee"},
+		{Normalization{StripDiacritics: true}, "Fée", "Fee"},
+		{Normalization{StripDiacritics: true}, "crüül", "cruul"},
+		{Normalization{Leetspeak: true}, "f33", "fee"},
+		{Normalization{Leetspeak: true}, "|33n7", "leent"},
+		{Normalization{CollapseRepeats: true}, "feeeee", "fee"},
+		{Normalization{CollapseRepeats: true}, "fee", "fee"},
+		{Normalization{CollapseRepeats: true}, "lent", "lent"},
+		{DefaultNormalization(), "ＦÉÉÉ", "fee"},
+		{DefaultNormalization(), "L33ÉNT", "leent"},
+	}
+
+	for i, tc := range testcases {
+		if normalized := tc.step.Normalize(tc.input); normalized != tc.expected {
+			t.Fatalf("Testcase %d failed: expected %q to normalize to %q, got %q", i, tc.input, tc.expected, normalized)
+		}
+	}
+}
+
+func TestLanguageReviewerNormalization(t *testing.T) {
+	testcases := []struct {
+		input  string
+		step   Normalization
+		passes bool
+	}{
+		{"what a FEE", Normalization{}, true},
+		{"what a FEE", Normalization{FoldCase: true}, false},
+		{"what a f.e.e", Normalization{}, true},
+		{"what a f.e.e", Normalization{JoinLetters: true}, false},
+		{"what a f e e", Normalization{JoinLetters: true}, true},
+		{"what a Fée", Normalization{FoldCase: true}, true},
+		{"what a Fée", Normalization{FoldCase: true, StripDiacritics: true}, false},
+		{"what a f33", Normalization{}, true},
+		{"what a f33", Normalization{Leetspeak: true}, false},
+		{"what a ｆｅｅ", Normalization{}, true},
+		{"what a ｆｅｅ", Normalization{NFKC: true}, false},
+		{"what a feeeee", Normalization{}, true},
+		{"what a feeeee", Normalization{CollapseRepeats: true}, false},
+		{"what a coffee", DefaultNormalization(), true},
+		{"what a fine product", DefaultNormalization(), true},
+		// ordinary words mustn't collapse into blacklisted ones
+		{"I lent this bike to my brother and he loved it", DefaultNormalization(), true},
+		{"Ne pas acheter", DefaultNormalization(), true},
+		{"The fe content of the frame", DefaultNormalization(), true},
+		{"what a leeeent", DefaultNormalization(), false},
+	}
+
+	for i, tc := range testcases {
+		r := DefaultLanguageReviewer()
+		r.Normalization = tc.step
+		if outcome := r.Review(&ProductReview{Review: tc.input}); outcome != tc.passes {
+			t.Fatalf("Testcase %d failed: expected %t for %q, got %t", i, tc.passes, tc.input, outcome)
+		}
+	}
+
+	d := DefaultLanguageReviewer().Decide(&ProductReview{Review: "a f.e.e!"})
+	if len(d.Evidence) != 1 || d.Evidence[0] != (Evidence{Term: "f.e.e", Position: 2, Detail: "matches fee"}) {
+		t.Fatalf("Expected the joined letters as evidence, got %v", d.Evidence)
+	}
+}
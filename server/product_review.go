@@ -6,6 +6,10 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/sjbodzo/review_system/db"
 	"github.com/sjbodzo/review_system/queue"
@@ -19,8 +23,57 @@ type AddReviewResponse struct {
 	Errors   []string `json:"errors,omitempty"`
 }
 
-// ProductReview is the handler for adding/updating product reviews
-func ProductReview(db *db.Wrapper, pool *queue.WorkerPool) http.HandlerFunc {
+// GetReviewResponse stores the response to a request for a single review
+type GetReviewResponse struct {
+	Success bool                 `json:"success"`
+	Review  *db.ProductReviewRow `json:"review,omitempty"`
+	Errors  []string             `json:"errors,omitempty"`
+}
+
+// reviewIDFromPath parses the trailing review id out of a path like /v1/api/reviews/{id}
+func reviewIDFromPath(p string) (id int, ok bool) {
+	id, err := strconv.Atoi(path.Base(p))
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// reviewPriority returns how to decide which priority lane a review is queued in, given the
+// status it had before it was saved, using the given rules. Anything the rules need looking up
+// is looked up straight away, rather than while the review is being saved.
+func reviewPriority(wrapper *db.Wrapper, rules *queue.PriorityRules,
+	req *review.ProductReview) func(previous db.ReviewStatus) int {
+	if rules == nil {
+		return func(db.ReviewStatus) int { return int(queue.PriorityNormal) }
+	}
+
+	var product *db.ProductRow
+	if rules.NeedsProduct() {
+		var err error
+		product, err = wrapper.GetProduct(req.ProductID)
+		if err != nil && err != db.ErrNotFound {
+			log.Println(err) // still queue the review, just without the product rules applying
+		}
+	}
+
+	var verified *bool
+	if rules.NeedsPurchase() {
+		purchased, err := wrapper.HasPurchased(req.EmailAddress, req.ProductID)
+		if err != nil {
+			log.Println(err) // likewise, without the purchase rules applying
+		} else {
+			verified = &purchased
+		}
+	}
+	return func(previous db.ReviewStatus) int {
+		return int(rules.Prioritize(req, previous, product, verified))
+	}
+}
+
+// ProductReview is the handler for adding/updating product reviews, and fetching them back by id.
+// Saved reviews are queued with the priority the rules give them, if there are any.
+func ProductReview(wrapper *db.Wrapper, rules *queue.PriorityRules) http.HandlerFunc {
 	// fmtResponse formats the response as json for the client
 	fmtResponse := func(reviewID *int, errors []error) string {
 		var response AddReviewResponse
@@ -47,6 +100,20 @@ func ProductReview(db *db.Wrapper, pool *queue.WorkerPool) http.HandlerFunc {
 		return string(m)
 	}
 
+	// fmtGetResponse formats the response to a get request as json for the client
+	fmtGetResponse := func(row *db.ProductReviewRow, err error) []byte {
+		response := GetReviewResponse{Success: err == nil, Review: row}
+		if err != nil {
+			response.Errors = []string{err.Error()}
+		}
+
+		m, err := json.Marshal(&response)
+		if err != nil {
+			panic(err)
+		}
+		return m
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodPost:
@@ -72,21 +139,59 @@ func ProductReview(db *db.Wrapper, pool *queue.WorkerPool) http.HandlerFunc {
 			// Sanitize the input to avoid XSS attacks
 			req.Sanitize()
 
-			// request is valid, write it to the db & queue up for processing
-			id, err := db.UpsertReview(req.ProductID, req.ReviewerName, req.EmailAddress, req.Rating, req.Review)
+			// the review is dated when it's received, whatever the client says
+			req.ReviewDate = time.Now()
+
+			// request is valid, write it to the db along with an outbox entry, which the outbox
+			// relay then queues up for processing in the review's priority lane
+			payload, err := json.Marshal(&req)
+			if err != nil {
+				log.Println(err)
+				http.Error(w, fmtResponse(nil, []error{fmt.Errorf("Server error")}), http.StatusBadRequest)
+				return
+			}
+			id, _, err := wrapper.UpsertReview(req.ProductID, req.ReviewerName, req.EmailAddress, req.Rating,
+				req.Review, payload, reviewPriority(wrapper, rules, &req))
 			if err != nil {
 				log.Println(err) // log error, but hide it from the client
 				http.Error(w, fmtResponse(nil, []error{fmt.Errorf("Server error")}), http.StatusBadRequest)
 				return
 			}
-			go pool.PushReview(req, "req_queue", 0)
-
 			m, _ := json.Marshal(&AddReviewResponse{
 				ReviewID: id,
 				Success:  true,
 			})
 			w.WriteHeader(http.StatusOK)
-			fmt.Fprintf(w, string(m))
+			w.Write(m)
+			return
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			id, ok := reviewIDFromPath(r.URL.Path)
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write(fmtGetResponse(nil, fmt.Errorf("Review ID must be a positive integer")))
+				return
+			}
+
+			row, err := wrapper.GetReviewByID(id)
+			if err == db.ErrNotFound {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write(fmtGetResponse(nil, fmt.Errorf("Review %d not found", id)))
+				return
+			} else if err != nil {
+				log.Println(err) // log error, but hide it from the client
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write(fmtGetResponse(nil, fmt.Errorf("Server error")))
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			w.Write(fmtGetResponse(row, nil))
+			return
+		default:
+			w.Header().Set("Allow", strings.Join([]string{http.MethodGet, http.MethodPost}, ", "))
+			http.Error(w, fmtResponse(nil, []error{fmt.Errorf("Method %s not allowed", r.Method)}),
+				http.StatusMethodNotAllowed)
 			return
 		}
 	}
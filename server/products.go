@@ -0,0 +1,271 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sjbodzo/review_system/db"
+)
+
+// defaultPageSize and maxPageSize bound how many reviews are listed per page
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// ListReviewsResponse stores the response to a request listing a product's reviews
+type ListReviewsResponse struct {
+	Success    bool                  `json:"success"`
+	Reviews    []db.ProductReviewRow `json:"reviews,omitempty"`
+	Total      int                   `json:"total"`
+	NextCursor string                `json:"nextCursor,omitempty"`
+	Errors     []string              `json:"errors,omitempty"`
+}
+
+// RatingSummaryResponse stores the response to a request for a product's rating summary
+type RatingSummaryResponse struct {
+	Success       bool        `json:"success"`
+	ProductID     int         `json:"productid,omitempty"`
+	Name          string      `json:"name,omitempty"`
+	ProductNumber string      `json:"productNumber,omitempty"`
+	ListPrice     *float64    `json:"listPrice,omitempty"` // a pointer, so a free product's 0 is kept
+	ReviewCount   int         `json:"reviewCount"`
+	AverageRating float64     `json:"averageRating"`
+	Histogram     map[int]int `json:"histogram,omitempty"`
+	Errors        []string    `json:"errors,omitempty"`
+}
+
+// encodeCursor turns the last review on a page into an opaque cursor for the client
+func encodeCursor(row *db.ProductReviewRow) string {
+	s := fmt.Sprint(row.ReviewDate.Format(time.RFC3339Nano), "|", row.ProductReviewID)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// decodeCursor parses a cursor previously handed out by encodeCursor
+func decodeCursor(cursor string) (*db.ReviewCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+	parts := strings.SplitN(string(b), "|", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+	date, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+	return &db.ReviewCursor{ReviewDate: date, ProductReviewID: id}, nil
+}
+
+// parseDate accepts either a full RFC3339 timestamp or a plain YYYY-MM-DD date. A plain date
+// is the start of that day, or its very end (to the microsecond, as precise as postgres
+// timestamps get) if endOfDay is set.
+func parseDate(s string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err == nil && endOfDay {
+		t = t.AddDate(0, 0, 1).Add(-time.Microsecond)
+	}
+	return t, err
+}
+
+// parseListQuery reads the filters and paging parameters out of the query string
+func parseListQuery(r *http.Request, productID int) (filter db.ReviewFilter, after *db.ReviewCursor, limit int, errors []error) {
+	q := r.URL.Query()
+	filter.ProductID = productID
+
+	limit = defaultPageSize
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageSize {
+			errors = append(errors, fmt.Errorf("Limit must be a value in the range of 1 to %d", maxPageSize))
+		} else {
+			limit = n
+		}
+	}
+
+	// rating filters on an exact rating, min/maxRating on a range, so they can't be combined
+	if q.Get("rating") != "" && (q.Get("minRating") != "" || q.Get("maxRating") != "") {
+		errors = append(errors, fmt.Errorf("rating can't be combined with minRating or maxRating"))
+	}
+	ratings := []struct {
+		param string
+		dest  []**int
+	}{
+		{"rating", []**int{&filter.MinRating, &filter.MaxRating}},
+		{"minRating", []**int{&filter.MinRating}},
+		{"maxRating", []**int{&filter.MaxRating}},
+	}
+	for _, rating := range ratings {
+		s := q.Get(rating.param)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 5 {
+			errors = append(errors, fmt.Errorf("%s must be a value in the range of 1 to 5", rating.param))
+			continue
+		}
+		for _, dest := range rating.dest {
+			*dest = &n
+		}
+	}
+
+	// both ends are inclusive, so until=2019-01-31 takes in the whole of that day
+	dates := []struct {
+		param    string
+		dest     **time.Time
+		endOfDay bool
+	}{
+		{"since", &filter.Since, false},
+		{"until", &filter.Until, true},
+	}
+	for _, date := range dates {
+		s := q.Get(date.param)
+		if s == "" {
+			continue
+		}
+		t, err := parseDate(s, date.endOfDay)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("%s must be a date formatted as YYYY-MM-DD or RFC3339", date.param))
+			continue
+		}
+		*date.dest = &t
+	}
+
+	if s := q.Get("cursor"); s != "" {
+		cursor, err := decodeCursor(s)
+		if err != nil {
+			errors = append(errors, err)
+		}
+		after = cursor
+	}
+
+	return filter, after, limit, errors
+}
+
+// Products is the handler for the read-only product resources, i.e. /products/{id}/reviews
+// and /products/{id}/rating-summary
+func Products(wrapper *db.Wrapper) http.HandlerFunc {
+	// writeResponse formats the response as json for the client
+	writeResponse := func(w http.ResponseWriter, status int, response interface{}) {
+		m, err := json.Marshal(response)
+		if err != nil {
+			panic(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(m)
+	}
+
+	// listReviews lists the approved reviews for a product, a page at a time
+	listReviews := func(w http.ResponseWriter, r *http.Request, productID int) {
+		filter, after, limit, errs := parseListQuery(r, productID)
+		if errs != nil {
+			var errMsgs []string
+			for _, err := range errs {
+				errMsgs = append(errMsgs, err.Error())
+			}
+			writeResponse(w, http.StatusBadRequest, &ListReviewsResponse{Errors: errMsgs})
+			return
+		}
+
+		// fetch one extra review to find out whether there is another page after this one
+		reviews, err := wrapper.ListApprovedReviews(filter, after, limit+1)
+		if err != nil {
+			log.Println(err) // log error, but hide it from the client
+			writeResponse(w, http.StatusInternalServerError, &ListReviewsResponse{Errors: []string{"Server error"}})
+			return
+		}
+		total, err := wrapper.CountApprovedReviews(filter)
+		if err != nil {
+			log.Println(err)
+			writeResponse(w, http.StatusInternalServerError, &ListReviewsResponse{Errors: []string{"Server error"}})
+			return
+		}
+
+		response := ListReviewsResponse{Success: true, Total: total}
+		if len(reviews) > limit {
+			reviews = reviews[:limit]
+			response.NextCursor = encodeCursor(&reviews[limit-1])
+		}
+		response.Reviews = reviews
+		writeResponse(w, http.StatusOK, &response)
+	}
+
+	// ratingSummary summarizes the ratings of a product's approved reviews
+	ratingSummary := func(w http.ResponseWriter, r *http.Request, productID int) {
+		product, err := wrapper.GetProduct(productID)
+		if err == db.ErrNotFound {
+			writeResponse(w, http.StatusNotFound,
+				&RatingSummaryResponse{Errors: []string{fmt.Sprintf("Product %d not found", productID)}})
+			return
+		} else if err != nil {
+			log.Println(err) // log error, but hide it from the client
+			writeResponse(w, http.StatusInternalServerError, &RatingSummaryResponse{Errors: []string{"Server error"}})
+			return
+		}
+
+		summary, err := wrapper.GetRatingSummary(productID)
+		if err != nil {
+			log.Println(err)
+			writeResponse(w, http.StatusInternalServerError, &RatingSummaryResponse{Errors: []string{"Server error"}})
+			return
+		}
+
+		writeResponse(w, http.StatusOK, &RatingSummaryResponse{
+			Success:       true,
+			ProductID:     product.ProductID,
+			Name:          product.Name,
+			ProductNumber: product.ProductNumber,
+			ListPrice:     &product.ListPrice,
+			ReviewCount:   summary.Count,
+			AverageRating: math.Round(summary.Average*100) / 100,
+			Histogram:     summary.Histogram,
+		})
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeResponse(w, http.StatusMethodNotAllowed,
+				&ListReviewsResponse{Errors: []string{fmt.Sprintf("Method %s not allowed", r.Method)}})
+			return
+		}
+
+		// paths look like /{version}/api/products/{id}/{resource}
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) < 2 {
+			http.NotFound(w, r)
+			return
+		}
+		productID, err := strconv.Atoi(parts[len(parts)-2])
+		if err != nil || productID <= 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch parts[len(parts)-1] {
+		case "reviews":
+			listReviews(w, r, productID)
+		case "rating-summary":
+			ratingSummary(w, r, productID)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
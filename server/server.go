@@ -9,13 +9,18 @@ import (
 	"github.com/sjbodzo/review_system/queue"
 )
 
-// New returns a new Server instance that can respond to requests to store reviews
-func New(port int, version string, wrapper *db.Wrapper, pool *queue.WorkerPool) (*http.Server, error) {
+// New returns a new Server instance that can respond to requests to store and read reviews.
+// Saved reviews are queued with the priority the rules give them, or normal priority if
+// rules is nil.
+func New(port int, version string, wrapper *db.Wrapper, rules *queue.PriorityRules) (*http.Server, error) {
 	if wrapper == nil {
 		return nil, fmt.Errorf("Server requires database to write to")
 	}
 
-	http.HandleFunc(fmt.Sprint("/", version, "/api/reviews"), ProductReview(wrapper, pool))
+	reviews := ProductReview(wrapper, rules)
+	http.HandleFunc(fmt.Sprint("/", version, "/api/reviews"), reviews)
+	http.HandleFunc(fmt.Sprint("/", version, "/api/reviews/"), reviews)
+	http.HandleFunc(fmt.Sprint("/", version, "/api/products/"), Products(wrapper))
 
 	srv := &http.Server{
 		Handler:      http.DefaultServeMux,